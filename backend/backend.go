@@ -2,19 +2,27 @@ package backend
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/proxyproto"
 )
 
-const holdUpAfterAssign = 100
+const (
+	holdUpAfterAssign = 100
+
+	copyBufferSize = 32 << 10
+)
 
 // Backend is a struct that contains all the configuration
 // of the backend server.
@@ -23,18 +31,39 @@ type Backend struct {
 	healthCheckTcpTimeout time.Duration
 	mux                   sync.Mutex
 	alive                 bool
-	requestChan           chan bool
+	draining              bool
+	proxyProtocol         bool
+	limit                 *concurrencyLimit
+	dial                  dialFunc
+	tlsConfig             *tls.Config
+	transport             transport
+	client                *http.Client
+	timeout               time.Duration
+	metrics               *backendMetrics
 }
 
-// NewBackend creates a new Backend.
+// NewBackend creates a new Backend with the default transport settings.
 func NewBackend(url *url.URL, healthCheckTimeout time.Duration, maxRequests int32) *Backend {
-	c := make(chan bool, maxRequests)
+	return newBackend(url, healthCheckTimeout, config.ServerConfig{MaximalRequests: maxRequests}, nil)
+}
+
+func newBackend(url *url.URL, healthCheckTimeout time.Duration, server config.ServerConfig, tlsConfig *tls.Config) *Backend {
+	m := newBackendMetrics(url.String())
+	dial := newDialer(server, m)
+	transport := newTransport(server, dial, tlsConfig)
 	return &Backend{
 		url:                   url,
 		healthCheckTcpTimeout: healthCheckTimeout,
 		mux:                   sync.Mutex{},
 		alive:                 false,
-		requestChan:           c,
+		limit:                 newConcurrencyLimit(m, server.MaximalRequests, server.ConcurrencyLimit),
+		proxyProtocol:         server.ProxyProtocol,
+		dial:                  dial,
+		tlsConfig:             tlsConfig,
+		transport:             transport,
+		client:                &http.Client{Transport: transport},
+		timeout:               time.Duration(server.Timeout) * time.Millisecond,
+		metrics:               m,
 	}
 }
 
@@ -46,10 +75,27 @@ func NewBackendConfig(server config.ServerConfig) *Backend {
 		return nil
 	}
 
+	// h2c multiplexes the requests of different clients over one connection,
+	// while the PROXY header tells the address of a single client
+	if server.H2C && server.ProxyProtocol {
+		logger.Errorf("Failed to configure %s: h2c can't be used with PROXY protocol\n", server.URL)
+		return nil
+	}
+
+	if err := checkConcurrencyLimit(server.ConcurrencyLimit); err != nil {
+		logger.Errorf("Failed to configure %s: %s\n", server.URL, err)
+		return nil
+	}
+
+	tlsConfig, err := newUpstreamTLSConfig(server.TLS)
+	if err != nil {
+		logger.Errorf("Failed to configure TLS of %s: %s\n", server.URL, err)
+		return nil
+	}
+
 	u := parsed
 	h := time.Duration(server.HealthCheckTcpTimeout) * time.Millisecond
-	max := server.MaximalRequests
-	return NewBackend(u, h, max)
+	return newBackend(u, h, server, tlsConfig)
 }
 
 // URL returns the URL of the backend.
@@ -62,6 +108,17 @@ func (b *Backend) HealthCheckTcpTimeout() time.Duration {
 	return b.healthCheckTcpTimeout
 }
 
+// Timeout returns the time limit of a request to the backend, zero means no limit.
+func (b *Backend) Timeout() time.Duration {
+	return b.timeout
+}
+
+// CloseIdleConnections closes the idle connections to the backend.
+// It's used when the backend is removed from the pool.
+func (b *Backend) CloseIdleConnections() {
+	b.transport.CloseIdleConnections()
+}
+
 // Lock are used to lock the backend.
 func (b *Backend) Lock() {
 	b.mux.Lock()
@@ -77,31 +134,52 @@ func (b *Backend) Alive() bool {
 	return b.alive
 }
 
-// AssignRequest returns true if backend's channel is not full.
-// Apart from that, channel gets a new item.
+// Draining returns true if the backend doesn't take new requests
+// and is waiting for the current ones to be completed.
+func (b *Backend) Draining() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.draining
+}
+
+// SetDraining sets the backend to draining or not draining.
+func (b *Backend) SetDraining(draining bool) {
+	b.Lock()
+	b.draining = draining
+	b.Unlock()
+}
+
+// ActiveRequests returns how many requests are being processed on the backend.
+func (b *Backend) ActiveRequests() int {
+	return b.limit.Active()
+}
+
+// AssignRequest returns true if the backend has a free slot for the request,
+// the slot is waited for a short time.
 func (b *Backend) AssignRequest() bool {
-	timer := time.NewTimer(holdUpAfterAssign * time.Millisecond)
-	defer timer.Stop()
+	return b.limit.acquire(holdUpAfterAssign * time.Millisecond)
+}
 
-	select {
-	case b.requestChan <- true:
-		return true
-	case <-timer.C:
-		return false
-	}
+// TryAssignRequest takes a slot of the backend if there's a free one without waiting.
+func (b *Backend) TryAssignRequest() bool {
+	return b.limit.acquire(0)
 }
 
+// Free releases the slot taken by AssignRequest or TryAssignRequest.
 func (b *Backend) Free() bool {
-	select {
-	case <-b.requestChan:
-		return true
-	default:
-		return false
-	}
+	return b.limit.release()
+}
+
+// LimitAlgorithm returns the algorithm of the adaptive concurrency limit,
+// it's empty if the limit is static.
+func (b *Backend) LimitAlgorithm() string {
+	return b.limit.algorithm
 }
 
+// MaximalRequests returns the current limit of concurrent requests,
+// it changes at runtime if the limit is adaptive.
 func (b *Backend) MaximalRequests() int {
-	return cap(b.requestChan)
+	return b.limit.Limit()
 }
 
 type responseError struct {
@@ -119,6 +197,10 @@ func (b *Backend) SetAlive(alive bool) {
 
 // CheckIfAlive checks if the backend is alive.
 func (b *Backend) CheckIfAlive() bool {
+	if b.URL().Scheme == "udp" {
+		return b.checkUDP()
+	}
+
 	conn, err := net.DialTimeout("tcp", b.URL().Host, b.HealthCheckTcpTimeout())
 	if err != nil {
 		logger.Warnf("Connection problem: %v", err)
@@ -131,16 +213,60 @@ func (b *Backend) CheckIfAlive() bool {
 			logger.Errorf("Failed to close connection: %v", err)
 		}
 	}(conn)
+
+	// the backend expects a header on every connection, LOCAL one means a health check
+	if b.proxyProtocol {
+		if err := proxyproto.WriteHeaderV2(conn, nil, nil); err != nil {
+			logger.Warnf("Connection problem: %v", err)
+			return false
+		}
+	}
 	return true
 }
 
+// checkUDP sends an empty datagram to the backend. UDP has no handshake,
+// so the backend is down only if the host answers "port unreachable".
+func (b *Backend) checkUDP() bool {
+	conn, err := net.DialTimeout("udp", b.URL().Host, b.HealthCheckTcpTimeout())
+	if err != nil {
+		logger.Warnf("Connection problem: %v", err)
+		return false
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(nil); err != nil {
+		logger.Warnf("Connection problem: %v", err)
+		return false
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(b.HealthCheckTcpTimeout()))
+	var netErr net.Error
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		logger.Warnf("Connection problem: %v", err)
+		return false
+	}
+	return true
+}
+
+// Dial opens a raw connection to the backend.
+// The client address is taken from ctx if the backend uses PROXY protocol.
+func (b *Backend) Dial(ctx context.Context) (net.Conn, error) {
+	return b.dial(ctx, "tcp", hostPort(b.URL().Scheme, b.URL().Host))
+}
+
 // SendRequestToBackend returns error if there is an error on backend side.
 func (b *Backend) SendRequestToBackend(req *http.Request) (*http.Response, error) {
 	logger.Infof("[%s] received a request\n", b.URL())
 
 	// send it to the backend
 	r := b.prepareRequest(req)
+	start := time.Now()
 	resp, respError := b.makeRequest(r)
+
+	// canceled requests say nothing about the backend
+	if respError == nil || !errors.Is(respError.err, context.Canceled) {
+		b.limit.observe(time.Since(start), respError != nil)
+	}
 	if respError != nil {
 		return nil, respError.err
 	}
@@ -148,35 +274,67 @@ func (b *Backend) SendRequestToBackend(req *http.Request) (*http.Response, error
 	return resp, nil
 }
 
-// WriteBodyAndReturn writes response to the client and returns the response body.
-func WriteBodyAndReturn(rw http.ResponseWriter, resp *http.Response) ([]byte, error) {
+// WriteResponse streams the response to the client and returns
+// the number of bytes of the body. The body is also written to tee if it isn't nil,
+// writing errors of tee are ignored.
+// Streaming responses (without Content-Length or Server-Sent Events)
+// are flushed to the client after each chunk.
+func WriteResponse(rw http.ResponseWriter, resp *http.Response, tee io.Writer) (int64, error) {
+	RemoveHopByHopHeaders(resp.Header)
 	for key, values := range resp.Header {
 		for _, value := range values {
 			rw.Header().Add(key, value)
 		}
 	}
+	rw.WriteHeader(resp.StatusCode)
 
-	byteArray, err := io.ReadAll(resp.Body)
-	if err != nil && !errors.Is(err, io.EOF) {
-		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
-		return nil, err
+	flusher, _ := rw.(http.Flusher)
+	if resp.ContentLength != -1 && !isEventStream(resp.Header) {
+		flusher = nil
 	}
-	resp.Body.Close()
 
-	_, err = rw.Write(byteArray)
-	if err != nil {
-		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
-		return nil, err
+	buf := make([]byte, copyBufferSize)
+	var written int64
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := rw.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+			if tee != nil {
+				_, _ = tee.Write(buf[:n])
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
 	}
-	return byteArray, nil
+}
+
+func isEventStream(h http.Header) bool {
+	return strings.HasPrefix(h.Get("Content-Type"), "text/event-stream")
 }
 
 func (b *Backend) prepareRequest(r *http.Request) *http.Request {
 	newReq := *r
 	req := &newReq
+	req.Header = prepareHeader(r)
+	if deadline, ok := r.Context().Deadline(); ok {
+		setDeadlineHeaders(req.Header, time.Until(deadline))
+	}
 	serverUrl := b.URL()
 
-	// set req Host, URL and Request URI to forward a request to the origin b
+	// set req Host, URL and Request URI to forward a request to the origin b,
+	// URL is copied as hedged requests are prepared concurrently
+	u := *r.URL
+	req.URL = &u
 	req.Host = serverUrl.Host
 	req.URL.Host = serverUrl.Host
 	req.URL.Scheme = serverUrl.Scheme
@@ -189,8 +347,15 @@ func (b *Backend) prepareRequest(r *http.Request) *http.Request {
 func (b *Backend) makeRequest(req *http.Request) (*http.Response, *responseError) {
 	respError := &responseError{request: req}
 
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			b.metrics.acquiredConnection(info.Reused)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
 	// save the response from the origin b
-	originServerResponse, err := http.DefaultClient.Do(req)
+	originServerResponse, err := b.client.Do(req)
 	// error handler
 	if err != nil {
 		if uerr, ok := err.(*url.Error); ok {
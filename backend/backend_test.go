@@ -0,0 +1,33 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/pelageech/BDUTS/config"
+)
+
+func TestNewBackendConfigRejectsH2CWithProxyProtocol(t *testing.T) {
+	server := config.ServerConfig{URL: "http://127.0.0.1:1", MaximalRequests: 1, H2C: true}
+	if NewBackendConfig(server) == nil {
+		t.Fatal("h2c backend isn't created")
+	}
+	server.ProxyProtocol = true
+	if NewBackendConfig(server) != nil {
+		t.Fatal("h2c backend with PROXY protocol is created")
+	}
+}
+
+func TestNewBackendConfigRejectsUnknownLimitAlgorithm(t *testing.T) {
+	for _, algorithm := range []string{limitAIMD, limitGradient} {
+		server := config.ServerConfig{URL: "http://127.0.0.1:1", MaximalRequests: 1, ConcurrencyLimit: &config.ConcurrencyLimitConfig{Algorithm: algorithm}}
+		if NewBackendConfig(server) == nil {
+			t.Errorf("backend with %q limit isn't created", algorithm)
+		}
+	}
+	for _, algorithm := range []string{"", "AIMD", "vegas"} {
+		server := config.ServerConfig{URL: "http://127.0.0.1:1", MaximalRequests: 1, ConcurrencyLimit: &config.ConcurrencyLimitConfig{Algorithm: algorithm}}
+		if NewBackendConfig(server) != nil {
+			t.Errorf("backend with %q limit is created", algorithm)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The remaining time of the request is sent to the backends so they can give up early.
+// X-Request-Timeout is in milliseconds, grpc-timeout is set for gRPC requests,
+// see https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md.
+const (
+	RequestTimeoutHeader = "X-Request-Timeout"
+	GRPCTimeoutHeader    = "Grpc-Timeout"
+
+	grpcTimeoutMaxDigits = 8
+)
+
+// hopByHopHeaders are meaningful only for a single connection
+// and mustn't be forwarded by proxies, see RFC 9110, 7.6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHopHeaders deletes hop-by-hop headers and the ones listed in Connection.
+func RemoveHopByHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// prepareHeader returns the header of the request to the backend.
+// Upgrade and `TE: trailers` (required by gRPC) are kept.
+func prepareHeader(req *http.Request) http.Header {
+	h := req.Header.Clone()
+	upgrade := ""
+	if IsUpgradeRequest(req) {
+		upgrade = req.Header.Get("Upgrade")
+	}
+	trailers := headerHasToken(req.Header, "Te", "trailers")
+
+	RemoveHopByHopHeaders(h)
+
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+	return h
+}
+
+// setDeadlineHeaders sets the time left for the backend to respond.
+func setDeadlineHeaders(h http.Header, left time.Duration) {
+	ms := left.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	h.Set(RequestTimeoutHeader, strconv.FormatInt(ms, 10))
+	if isGRPC(h) {
+		h.Set(GRPCTimeoutHeader, formatGRPCTimeout(left))
+	}
+}
+
+func isGRPC(h http.Header) bool {
+	return strings.HasPrefix(h.Get("Content-Type"), "application/grpc")
+}
+
+// grpcTimeoutUnits are the units of grpc-timeout from the smallest.
+var grpcTimeoutUnits = []struct {
+	d    time.Duration
+	unit byte
+}{
+	{time.Nanosecond, 'n'},
+	{time.Microsecond, 'u'},
+	{time.Millisecond, 'm'},
+	{time.Second, 'S'},
+	{time.Minute, 'M'},
+	{time.Hour, 'H'},
+}
+
+// formatGRPCTimeout formats d with the smallest unit fitting in 8 digits, rounding up like gRPC does.
+func formatGRPCTimeout(d time.Duration) string {
+	const maxValue = 99999999
+	if d <= 0 {
+		d = time.Nanosecond
+	}
+	for _, u := range grpcTimeoutUnits {
+		v := int64(d / u.d)
+		if d%u.d != 0 {
+			v++
+		}
+		if v <= maxValue {
+			return strconv.FormatInt(v, 10) + string(u.unit)
+		}
+	}
+	return strconv.Itoa(maxValue) + "H"
+}
+
+// ParseGRPCTimeout parses the value of grpc-timeout.
+func ParseGRPCTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 || len(s) > grpcTimeoutMaxDigits+1 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	for _, u := range grpcTimeoutUnits {
+		if s[len(s)-1] == u.unit {
+			return time.Duration(v) * u.d, true
+		}
+	}
+	return 0, false
+}
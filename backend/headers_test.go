@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFormatGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "1n"},
+		{-time.Second, "1n"},
+		{1500 * time.Nanosecond, "1500n"},
+		{99999999 * time.Nanosecond, "99999999n"},
+		{100 * time.Millisecond, "100000u"},
+		{100*time.Millisecond + 1, "100001u"},
+		{time.Second, "1000000u"},
+		{2 * time.Minute, "120000m"},
+		{200 * time.Hour, "720000S"},
+		{100000 * time.Hour, "6000000M"},
+		{time.Duration(math.MaxInt64), "2562048H"},
+	}
+	for _, tt := range tests {
+		if got := formatGRPCTimeout(tt.d); got != tt.want {
+			t.Errorf("formatGRPCTimeout(%s) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{"1n", time.Nanosecond, true},
+		{"250u", 250 * time.Microsecond, true},
+		{"100m", 100 * time.Millisecond, true},
+		{"5S", 5 * time.Second, true},
+		{"2M", 2 * time.Minute, true},
+		{"1H", time.Hour, true},
+		{"0m", 0, true},
+		{"99999999m", 99999999 * time.Millisecond, true},
+		{"123456789m", 0, false},
+		{"", 0, false},
+		{"m", 0, false},
+		{"10", 0, false},
+		{"10s", 0, false},
+		{"-1m", 0, false},
+		{"1.5S", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseGRPCTimeout(tt.s)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseGRPCTimeout(%q) = %s, %v, want %s, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestGRPCTimeoutRoundTrip checks that the backend isn't given more time than is left.
+func TestGRPCTimeoutRoundTrip(t *testing.T) {
+	for _, d := range []time.Duration{time.Nanosecond, 1234567 * time.Nanosecond, 3 * time.Second, 90 * time.Minute} {
+		got, ok := ParseGRPCTimeout(formatGRPCTimeout(d))
+		if !ok || got < d {
+			t.Errorf("%s is formatted as %s", d, got)
+		}
+	}
+}
+
+func TestSetDeadlineHeaders(t *testing.T) {
+	h := http.Header{}
+	setDeadlineHeaders(h, 1500*time.Microsecond)
+	if got := h.Get(RequestTimeoutHeader); got != "1" {
+		t.Errorf("%s = %q, want %q", RequestTimeoutHeader, got, "1")
+	}
+	if got := h.Get(GRPCTimeoutHeader); got != "" {
+		t.Errorf("%s is set for a request which isn't gRPC: %q", GRPCTimeoutHeader, got)
+	}
+
+	h.Set("Content-Type", "application/grpc+proto")
+	setDeadlineHeaders(h, 0)
+	if got := h.Get(RequestTimeoutHeader); got != "1" {
+		t.Errorf("%s = %q, want %q", RequestTimeoutHeader, got, "1")
+	}
+	if got := h.Get(GRPCTimeoutHeader); got != "1n" {
+		t.Errorf("%s = %q, want %q", GRPCTimeoutHeader, got, "1n")
+	}
+}
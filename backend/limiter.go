@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pelageech/BDUTS/config"
+)
+
+const (
+	limitAIMD     = "aimd"
+	limitGradient = "gradient"
+
+	defaultMinLimit = 1
+	defaultMaxLimit = 1000
+
+	// aimdBackoff multiplies the limit on a failed or too slow request.
+	aimdBackoff = 0.9
+
+	// gradient limit: the latency without queueing is estimated by the long-term
+	// average of the response time, gradientTolerance is the allowed excess of the latency.
+	gradientLongWindow = 600
+	gradientTolerance  = 1.5
+	gradientMin        = 0.5
+	gradientSmoothing  = 0.2
+	gradientDriftRatio = 2
+	gradientDriftDecay = 0.95
+)
+
+// concurrencyLimit bounds the number of requests processed on the backend at the same time.
+// The limit is static or adjusted by the response time of the backend.
+type concurrencyLimit struct {
+	mux      sync.Mutex
+	metrics  *backendMetrics
+	active   int
+	limit    float64
+	released chan struct{}
+
+	algorithm        string
+	min, max         float64
+	latencyThreshold time.Duration
+	longRTT          float64
+}
+
+// checkConcurrencyLimit returns an error if the algorithm of the adaptive limit is unknown.
+func checkConcurrencyLimit(c *config.ConcurrencyLimitConfig) error {
+	if c == nil {
+		return nil
+	}
+	switch c.Algorithm {
+	case limitAIMD, limitGradient:
+		return nil
+	}
+	return fmt.Errorf("unknown concurrency limit algorithm %q, expected %q or %q", c.Algorithm, limitAIMD, limitGradient)
+}
+
+func newConcurrencyLimit(m *backendMetrics, initial int32, c *config.ConcurrencyLimitConfig) *concurrencyLimit {
+	l := &concurrencyLimit{
+		metrics:  m,
+		limit:    float64(initial),
+		released: make(chan struct{}),
+	}
+	if c != nil {
+		l.algorithm = c.Algorithm
+		l.min, l.max = float64(c.MinLimit), float64(c.MaxLimit)
+		if l.min <= 0 {
+			l.min = defaultMinLimit
+		}
+		if l.max <= 0 {
+			l.max = defaultMaxLimit
+		}
+		l.latencyThreshold = time.Duration(c.LatencyThreshold) * time.Millisecond
+		l.limit = math.Min(math.Max(l.limit, l.min), l.max)
+	}
+	m.concurrencyLimit(l.Limit())
+	return l
+}
+
+// acquire takes a slot waiting for it at most wait.
+func (l *concurrencyLimit) acquire(wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		l.mux.Lock()
+		if l.active < int(l.limit) {
+			l.active++
+			l.mux.Unlock()
+			return true
+		}
+		released := l.released
+		l.mux.Unlock()
+
+		select {
+		case <-released:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// release frees a slot and wakes up the waiting requests.
+func (l *concurrencyLimit) release() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.active == 0 {
+		return false
+	}
+	l.active--
+	close(l.released)
+	l.released = make(chan struct{})
+	return true
+}
+
+// Active returns the number of the processed requests.
+func (l *concurrencyLimit) Active() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.active
+}
+
+// Limit returns the current limit.
+func (l *concurrencyLimit) Limit() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return int(l.limit)
+}
+
+// observe adjusts an adaptive limit by the response time of a request,
+// failed is true if the backend returned an error.
+func (l *concurrencyLimit) observe(rtt time.Duration, failed bool) {
+	if l.algorithm == "" {
+		return
+	}
+
+	l.mux.Lock()
+	old := int(l.limit)
+	switch l.algorithm {
+	case limitAIMD:
+		l.aimd(rtt, failed)
+	case limitGradient:
+		l.gradient(rtt, failed)
+	}
+	l.limit = math.Min(math.Max(l.limit, l.min), l.max)
+	limit := int(l.limit)
+	if limit > old {
+		close(l.released)
+		l.released = make(chan struct{})
+	}
+	l.mux.Unlock()
+
+	if limit != old {
+		l.metrics.concurrencyLimit(limit)
+	}
+}
+
+// aimd increases the limit by one per limit of successful requests if it's used
+// by a half at least, and decreases it multiplicatively on failures and slow responses.
+func (l *concurrencyLimit) aimd(rtt time.Duration, failed bool) {
+	if failed || (l.latencyThreshold > 0 && rtt > l.latencyThreshold) {
+		l.limit *= aimdBackoff
+		return
+	}
+	if float64(l.active)*2 >= l.limit {
+		l.limit += 1 / l.limit
+	}
+}
+
+// gradient scales the limit by the ratio of the latency without queueing
+// to the current one and adds the square root of the limit for probing.
+func (l *concurrencyLimit) gradient(rtt time.Duration, failed bool) {
+	if failed {
+		l.limit *= aimdBackoff
+		return
+	}
+
+	short := float64(rtt)
+	if l.longRTT == 0 {
+		l.longRTT = short
+	} else {
+		l.longRTT += (short - l.longRTT) / gradientLongWindow
+	}
+	// the backend has become faster, the long-term latency catches up
+	if l.longRTT/short > gradientDriftRatio {
+		l.longRTT *= gradientDriftDecay
+	}
+
+	gradient := math.Max(gradientMin, math.Min(1, gradientTolerance*l.longRTT/short))
+	newLimit := l.limit*gradient + math.Sqrt(l.limit)
+	// an unused limit isn't increased
+	if newLimit > l.limit && float64(l.active) < l.limit/2 {
+		return
+	}
+	l.limit = l.limit*(1-gradientSmoothing) + newLimit*gradientSmoothing
+}
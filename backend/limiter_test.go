@@ -0,0 +1,64 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/config"
+)
+
+func TestConcurrencyLimitAcquire(t *testing.T) {
+	l := newConcurrencyLimit(newBackendMetrics("test"), 1, nil)
+	if !l.acquire(time.Millisecond) {
+		t.Fatal("the free slot isn't acquired")
+	}
+	if l.acquire(10 * time.Millisecond) {
+		t.Fatal("the slot is acquired over the limit")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.release()
+	}()
+	if !l.acquire(time.Second) {
+		t.Fatal("the released slot isn't acquired")
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	l := newConcurrencyLimit(newBackendMetrics("test"), 10, &config.ConcurrencyLimitConfig{Algorithm: limitAIMD, LatencyThreshold: 100})
+
+	// the limit grows by one per its value of successful requests
+	l.active = 10
+	for i := 0; i < 11; i++ {
+		l.observe(10*time.Millisecond, false)
+	}
+	if n := l.Limit(); n != 11 {
+		t.Errorf("expected the limit to grow to 11, got %d", n)
+	}
+
+	l.observe(time.Second, false)
+	if n := l.Limit(); n >= 11 {
+		t.Errorf("expected the limit to decrease on a slow response, got %d", n)
+	}
+}
+
+func TestGradient(t *testing.T) {
+	l := newConcurrencyLimit(newBackendMetrics("test"), 20, &config.ConcurrencyLimitConfig{Algorithm: limitGradient})
+	l.active = 20
+	for i := 0; i < 50; i++ {
+		l.observe(10*time.Millisecond, false)
+	}
+	grown := l.Limit()
+	if grown <= 20 {
+		t.Errorf("expected the limit to grow at a stable latency, got %d", grown)
+	}
+
+	// queueing on the backend increases the latency
+	for i := 0; i < 20; i++ {
+		l.observe(100*time.Millisecond, false)
+	}
+	if n := l.Limit(); n >= grown {
+		t.Errorf("expected the limit to decrease at a growing latency, got %d of %d", n, grown)
+	}
+}
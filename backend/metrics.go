@@ -0,0 +1,57 @@
+package backend
+
+import (
+	"sync"
+
+	"github.com/pelageech/BDUTS/metrics"
+)
+
+// backendMetrics updates the series of the backend until it's removed from the pool,
+// so the connections closed after that don't recreate the deleted series.
+type backendMetrics struct {
+	mux     sync.RWMutex
+	name    string
+	removed bool
+}
+
+func newBackendMetrics(name string) *backendMetrics {
+	return &backendMetrics{name: name}
+}
+
+// update calls f with the name of the backend if it hasn't been removed.
+func (m *backendMetrics) update(f func(name string)) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if !m.removed {
+		f(m.name)
+	}
+}
+
+// delete removes the series of the backend and stops updating them.
+func (m *backendMetrics) delete() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.removed = true
+	metrics.DeleteBackend(m.name)
+}
+
+func (m *backendMetrics) dial(failed bool) {
+	m.update(func(name string) { metrics.UpdateBackendDials(name, failed) })
+}
+
+func (m *backendMetrics) openConnections(delta int) {
+	m.update(func(name string) { metrics.UpdateBackendOpenConnections(name, delta) })
+}
+
+func (m *backendMetrics) acquiredConnection(reused bool) {
+	m.update(func(name string) { metrics.UpdateBackendAcquiredConnections(name, reused) })
+}
+
+func (m *backendMetrics) concurrencyLimit(limit int) {
+	m.update(func(name string) { metrics.UpdateBackendConcurrencyLimit(name, limit) })
+}
+
+// UpdateUpgradedConnections counts the upgraded connections of the backend.
+func (b *Backend) UpdateUpgradedConnections(delta int) {
+	b.metrics.update(func(name string) { metrics.UpdateUpgradedConnections(name, delta) })
+}
@@ -0,0 +1,37 @@
+package backend
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/pelageech/BDUTS/metrics"
+)
+
+func TestRemovedBackendMetrics(t *testing.T) {
+	// the updates before metrics.Init are dropped
+	m := newBackendMetrics("http://127.0.0.1:1")
+	m.openConnections(1)
+	m.openConnections(-1)
+
+	metrics.Init(0, 0)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	name := "http://" + ln.Addr().String()
+	m = newBackendMetrics(name)
+	conn, err := countingDialer((&net.Dialer{}).DialContext, m)(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.delete()
+	_ = conn.Close()
+	if metrics.GlobalMetrics.BackendOpenConnections.DeleteLabelValues(name) {
+		t.Error("closing a connection of the removed backend recreated its series")
+	}
+}
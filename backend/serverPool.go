@@ -4,12 +4,18 @@ import (
 	"errors"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/pelageech/BDUTS/config"
 )
 
-const initCurrentBackend = -1
+const (
+	initCurrentBackend = -1
+
+	// drainCheckPeriod is how often a draining backend is checked for active requests.
+	drainCheckPeriod = 100 * time.Millisecond
+)
 
 var logger = log.NewWithOptions(os.Stderr, log.Options{
 	ReportTimestamp: true,
@@ -26,6 +32,9 @@ type ServerPool struct {
 	mux     sync.Mutex
 	servers []*Backend
 	current int32
+
+	// upstreamTLS is used by the backends without their own TLS settings
+	upstreamTLS *config.UpstreamTLSConfig
 }
 
 // NewServerPool creates a new ServerPool.
@@ -41,12 +50,28 @@ func NewServerPool() *ServerPool {
 // ConfigureServerPool creates a new ServerPool from config.ServerConfig.
 func (p *ServerPool) ConfigureServerPool(servers []config.ServerConfig) {
 	for _, server := range servers {
-		if b := NewBackendConfig(server); b != nil {
+		if b := p.NewBackend(server); b != nil {
 			p.AddServer(b)
 		}
 	}
 }
 
+// SetUpstreamTLS sets the TLS settings of the backends created by NewBackend
+// without their own ones. It must be called before the pool is configured.
+func (p *ServerPool) SetUpstreamTLS(c *config.UpstreamTLSConfig) {
+	p.upstreamTLS = c
+}
+
+// NewBackend creates a new Backend from config.ServerConfig
+// with the TLS settings of the pool if the server has no own ones.
+// The Backend isn't added to the pool.
+func (p *ServerPool) NewBackend(server config.ServerConfig) *Backend {
+	if server.TLS == nil {
+		server.TLS = p.upstreamTLS
+	}
+	return NewBackendConfig(server)
+}
+
 // Lock is used to lock the server pool.
 func (p *ServerPool) Lock() {
 	p.mux.Lock()
@@ -98,6 +123,8 @@ func (p *ServerPool) AddServer(b *Backend) {
 
 // FindServerByUrl finds a server by its URL.
 func (p *ServerPool) FindServerByUrl(url string) *Backend {
+	p.Lock()
+	defer p.Unlock()
 	for _, v := range p.servers {
 		if v.URL().String() == url {
 			return v
@@ -113,6 +140,8 @@ func (p *ServerPool) RemoveServerByUrl(url string) error {
 	for k, v := range p.servers {
 		if v.URL().String() == url {
 			p.servers = append(p.servers[:k], p.servers[k+1:]...)
+			v.CloseIdleConnections()
+			v.metrics.delete()
 			logger.Infof("[%s] removed from server pool\n", url)
 			return nil
 		}
@@ -120,6 +149,40 @@ func (p *ServerPool) RemoveServerByUrl(url string) error {
 	return errors.New("server not found")
 }
 
+// ErrDrainCanceled is returned by DrainServer if the server has been set
+// to not draining before it's removed.
+var ErrDrainCanceled = errors.New("drain is canceled")
+
+// DrainServer stops sending new requests to the server and removes it
+// from the server pool as soon as its active requests are completed
+// or the timeout is exceeded. The drain is canceled by SetDraining(false).
+func (p *ServerPool) DrainServer(url string, timeout time.Duration) error {
+	b := p.FindServerByUrl(url)
+	if b == nil {
+		return errors.New("server not found")
+	}
+	b.SetDraining(true)
+	logger.Infof("[%s] is draining\n", url)
+
+	ticker := time.NewTicker(drainCheckPeriod)
+	defer ticker.Stop()
+	deadline := time.Now().Add(timeout)
+	for b.ActiveRequests() > 0 && time.Now().Before(deadline) {
+		if !b.Draining() {
+			return ErrDrainCanceled
+		}
+		<-ticker.C
+	}
+	if !b.Draining() {
+		return ErrDrainCanceled
+	}
+	if n := b.ActiveRequests(); n > 0 {
+		logger.Warnf("[%s] drain timeout exceeded with %d active requests\n", url, n)
+	}
+
+	return p.RemoveServerByUrl(url)
+}
+
 // GetNextPeer returns the next server in the server pool.
 func (p *ServerPool) GetNextPeer() (*Backend, error) {
 	p.Lock()
@@ -128,7 +191,7 @@ func (p *ServerPool) GetNextPeer() (*Backend, error) {
 	serverList := p.Servers()
 	for i := 0; i < len(serverList); i++ {
 		p.IncrementCurrent()
-		if serverList[p.Current()].alive {
+		if s := serverList[p.Current()]; s.alive && !s.draining {
 			return p.GetCurrentServer(), nil
 		}
 	}
@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/proxyproto"
+	"github.com/pelageech/BDUTS/realip"
+	"golang.org/x/net/http2"
+)
+
+// Defaults of the transport, they are the same as http.DefaultTransport has.
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+
+	// HTTP/2 health checks of h2c connections
+	defaultPingTimeout      = 15 * time.Second
+	defaultWriteByteTimeout = 30 * time.Second
+)
+
+// transport is a connection pool of the backend.
+type transport interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// newDialer creates a dial function of the backend.
+// The connections are counted in the metrics of the backend.
+func newDialer(server config.ServerConfig, m *backendMetrics) dialFunc {
+	dialer := &net.Dialer{
+		Timeout:   msOrDefault(server.DialTimeout, defaultDialTimeout),
+		KeepAlive: msOrDefault(server.KeepAlive, defaultKeepAlive),
+	}
+	dial := countingDialer(dialer.DialContext, m)
+	if server.ProxyProtocol {
+		dial = proxyProtocolDialer(dial)
+	}
+	return dial
+}
+
+// newTransport creates a dedicated connection pool of the backend.
+func newTransport(server config.ServerConfig, dial dialFunc, tlsConfig *tls.Config) transport {
+	maxIdle := server.MaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = int(server.MaximalRequests)
+	}
+
+	if server.H2C {
+		return newH2CTransport(server, dial)
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   msOrDefault(server.TLSHandshakeTimeout, defaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: msOrDefault(server.ResponseHeaderTimeout, 0),
+		IdleConnTimeout:       msOrDefault(server.IdleConnTimeout, defaultIdleConnTimeout),
+		MaxIdleConnsPerHost:   maxIdle,
+		DisableKeepAlives:     server.DisableKeepAlives || server.ProxyProtocol,
+		ForceAttemptHTTP2:     server.HTTP2,
+	}
+}
+
+// newH2CTransport creates a pool of HTTP/2 connections over plain-text. There's one
+// connection carrying all the requests, so MaxIdleConnsPerHost and TLS settings aren't used.
+// The connection is dialed with the dial timeout and pinged after keepAlive without frames,
+// so a dead backend doesn't hang it.
+func newH2CTransport(server config.ServerConfig, dial dialFunc) transport {
+	// http2.Transport takes ResponseHeaderTimeout, IdleConnTimeout and
+	// DisableKeepAlives from the HTTP/1.1 transport it's configured for,
+	// the HTTP/1.1 transport itself is never used
+	t1 := &http.Transport{
+		ResponseHeaderTimeout: msOrDefault(server.ResponseHeaderTimeout, 0),
+		IdleConnTimeout:       msOrDefault(server.IdleConnTimeout, defaultIdleConnTimeout),
+		DisableKeepAlives:     server.DisableKeepAlives,
+	}
+	t2, err := http2.ConfigureTransports(t1)
+	if err != nil {
+		logger.Errorf("Failed to configure h2c transport of %s: %s\n", server.URL, err)
+		t2 = &http2.Transport{}
+	}
+
+	// the pool of ConfigureTransports only takes connections from t1, the default one dials
+	t2.ConnPool = nil
+	t2.AllowHTTP = true
+	t2.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		return dial(ctx, network, addr)
+	}
+	t2.ReadIdleTimeout = msOrDefault(server.KeepAlive, defaultKeepAlive)
+	t2.PingTimeout = defaultPingTimeout
+	t2.WriteByteTimeout = defaultWriteByteTimeout
+	return t2
+}
+
+// msOrDefault converts milliseconds from config to time.Duration.
+func msOrDefault(v int64, def time.Duration) time.Duration {
+	if v <= 0 {
+		return def
+	}
+	return time.Duration(v) * time.Millisecond
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// countingDialer wraps dial for counting dials and open connections.
+func countingDialer(dial dialFunc, m *backendMetrics) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		m.dial(err != nil)
+		if err != nil {
+			return nil, err
+		}
+		m.openConnections(1)
+		return &countedConn{Conn: conn, metrics: m}, nil
+	}
+}
+
+// proxyProtocolDialer sends PROXY protocol v2 header with the client address
+// taken from the context. LOCAL header is sent if there's no client.
+func proxyProtocolDialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var src, dst net.Addr
+		if ip, ok := realip.FromContext(ctx); ok {
+			src = &net.TCPAddr{IP: ip}
+			dst = conn.RemoteAddr()
+			if local, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+				dst = local
+			}
+		}
+
+		if err := proxyproto.WriteHeaderV2(conn, src, dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// countedConn decrements the open connections gauge on closing.
+type countedConn struct {
+	net.Conn
+	metrics *backendMetrics
+	once    sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		c.metrics.openConnections(-1)
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the connection if it's supported,
+// so half-closed TCP connections can be proxied.
+func (c *countedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
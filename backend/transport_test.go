@@ -0,0 +1,44 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestH2CTransportTimeouts(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = rw.Write([]byte(req.Proto))
+	}), &http2.Server{}))
+	defer server.Close()
+
+	c := config.ServerConfig{URL: server.URL, H2C: true, ResponseHeaderTimeout: 50}
+	tr := newTransport(c, newDialer(c, newBackendMetrics(server.URL)), nil)
+	defer tr.CloseIdleConnections()
+
+	req := httptest.NewRequest(http.MethodGet, server.URL+"/", nil)
+	req.RequestURI = ""
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %s", resp.Proto)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, server.URL+"/slow", nil)
+	req.RequestURI = ""
+	if resp, err := tr.RoundTrip(req); err == nil {
+		_ = resp.Body.Close()
+		t.Fatal("expected the response header timeout")
+	}
+}
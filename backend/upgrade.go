@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IsUpgradeRequest checks if the client asks for switching the protocol,
+// e.g. for opening a WebSocket.
+func IsUpgradeRequest(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" && headerHasToken(req.Header, "Connection", "upgrade")
+}
+
+// headerHasToken checks if the comma-separated header contains the token.
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// defaultUpgradeTimeout limits the handshake of an upgrade if neither the request
+// nor the backend has a timeout.
+const defaultUpgradeTimeout = 30 * time.Second
+
+// DialUpgrade opens a new connection to the backend and sends the upgrade request there.
+// The connection is returned together with the backend's response and must be closed
+// by the caller. If the status is 101 Switching Protocols, the connection carries
+// the upgraded protocol. The handshake is limited by the deadline of the request
+// or by the timeout of the backend, the upgraded connection has no deadline.
+func (b *Backend) DialUpgrade(req *http.Request) (net.Conn, *http.Response, error) {
+	logger.Infof("[%s] received an upgrade request\n", b.URL())
+
+	r := b.prepareRequest(req)
+	conn, err := b.Dial(req.Context())
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := conn.SetDeadline(b.upgradeDeadline(req.Context())); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if b.URL().Scheme == "https" || b.URL().Scheme == "wss" {
+		tlsConn := tls.Client(conn, b.upgradeTLSConfig())
+		if err := tlsConn.HandshakeContext(req.Context()); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+
+	if err := r.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// the backend may have sent the first bytes of the new protocol right after the response
+	return &bufferedConn{Conn: conn, r: br}, resp, nil
+}
+
+// upgradeDeadline returns the time the backend must answer the upgrade request by.
+func (b *Backend) upgradeDeadline(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	if b.timeout > 0 {
+		return time.Now().Add(b.timeout)
+	}
+	return time.Now().Add(defaultUpgradeTimeout)
+}
+
+// upgradeTLSConfig returns TLS settings for a raw connection, HTTP/1.1
+// is the only protocol where Upgrade works.
+func (b *Backend) upgradeTLSConfig() *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if b.tlsConfig != nil {
+		cfg = b.tlsConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = b.URL().Hostname()
+	}
+	cfg.NextProtos = []string{"http/1.1"}
+	return cfg
+}
+
+// hostPort adds the default port of the scheme to host if it has no port.
+func hostPort(scheme, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	switch scheme {
+	case "https", "wss":
+		return net.JoinHostPort(host, "443")
+	default:
+		return net.JoinHostPort(host, "80")
+	}
+}
+
+// bufferedConn is net.Conn reading through the buffer
+// which may contain already received bytes.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -17,6 +17,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -89,7 +90,9 @@ type UrlToKeyBuilder map[string]func(r *http.Request) string
 // The driver is a boltDB database containing buckets named by request hash.
 // Each of buckets has metadata struct and an amount of usage the page during its life.
 type CachingProperties struct {
-	db *bolt.DB
+	dbMux  sync.RWMutex
+	db     *bolt.DB
+	dbPath string
 	//	keyBuilderMap UrlToKeyBuilder
 	cleaner    *CacheCleaner
 	Size       int64
@@ -155,16 +158,37 @@ type responseDirectives struct {
 func NewCachingProperties(db *bolt.DB, cleaner *CacheCleaner) *CachingProperties {
 	return &CachingProperties{
 		db:         db,
+		dbPath:     db.Path(),
 		cleaner:    cleaner,
 		Size:       0,
 		PagesCount: 0,
 	}
 }
 
+// DB returns the database of the cache, it's changed by Reopen.
 func (p *CachingProperties) DB() *bolt.DB {
+	p.dbMux.RLock()
+	defer p.dbMux.RUnlock()
 	return p.db
 }
 
+// Close closes the database of the cache.
+func (p *CachingProperties) Close() error {
+	return p.DB().Close()
+}
+
+// Reopen opens the closed database of the cache again.
+func (p *CachingProperties) Reopen(options *bolt.Options) error {
+	db, err := OpenDatabase(p.dbPath, options)
+	if err != nil {
+		return err
+	}
+	p.dbMux.Lock()
+	p.db = db
+	p.dbMux.Unlock()
+	return nil
+}
+
 func (p *CachingProperties) Cleaner() *CacheCleaner {
 	return p.cleaner
 }
@@ -190,7 +214,7 @@ func (p *CachingProperties) CalculateSize() {
 		return err
 	}
 
-	err := p.db.View(func(tx *bolt.Tx) error {
+	err := p.DB().View(func(tx *bolt.Tx) error {
 		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
 			metaBytes := b.Get([]byte(pageMetadataKey))
 			if metaBytes == nil {
@@ -262,8 +286,8 @@ func (p *CachingProperties) ClearCache() error {
 }
 
 // OpenDatabase opens a database file.
-func OpenDatabase(path string) (*bolt.DB, error) {
-	db, err := bolt.Open(path, readWriteOwner, nil)
+func OpenDatabase(path string, options *bolt.Options) (*bolt.DB, error) {
+	db, err := bolt.Open(path, readWriteOwner, options)
 	if err != nil {
 		return nil, err
 	}
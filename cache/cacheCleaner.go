@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -36,10 +37,14 @@ func NewCacheCleaner(dbFile *os.File, maxFileSize int64, fillFactor float64, fre
 
 // Observe occasionally sets up a cleaner's goroutine which
 // deletes expired and unnecessary pages from the cache.
-// The frequency is declared in CacheCleaner struct.
-func (p *CachingProperties) Observe() {
+// The frequency is declared in CacheCleaner struct. It stops when ctx is done.
+func (p *CachingProperties) Observe(ctx context.Context) {
 	for {
-		<-p.cleaner.frequency.C
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.cleaner.frequency.C:
+		}
 		if p.isSizeExceeded() {
 			func() {
 				size, err := p.deleteExpiredCache()
@@ -128,7 +133,7 @@ func (p *CachingProperties) deletePagesLRU() (int64, error) {
 	}
 
 	var lruItems []lruItem
-	err := p.db.View(func(tx *bolt.Tx) error {
+	err := p.DB().View(func(tx *bolt.Tx) error {
 		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
 			bytes := b.Get([]byte(usesKey))
 			if bytes == nil {
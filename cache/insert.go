@@ -56,7 +56,7 @@ func (p *CachingProperties) insertPageMetadataToDB(key []byte, meta *PageMetadat
 		return err
 	}
 
-	err = p.db.Update(func(tx *bolt.Tx) error {
+	err = p.DB().Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucket(key)
 		if errors.Is(err, bolt.ErrBucketExists) {
 			b = tx.Bucket(key)
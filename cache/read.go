@@ -59,7 +59,7 @@ func (p *CachingProperties) GetPageFromCache(key []byte, req *http.Request) (*Pa
 func (p *CachingProperties) getPageMetadata(key []byte) (*PageMetadata, error) {
 	var result []byte = nil
 
-	err := p.db.View(func(tx *bolt.Tx) error {
+	err := p.DB().View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(key)
 		if b == nil {
 			return errors.New("missed cache")
@@ -76,7 +76,7 @@ func (p *CachingProperties) getPageMetadata(key []byte) (*PageMetadata, error) {
 		return nil, err
 	}
 
-	_ = p.db.Update(func(tx *bolt.Tx) error {
+	_ = p.DB().Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(key)
 		bs := b.Get([]byte(usesKey))
 		if bs == nil {
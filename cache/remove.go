@@ -33,7 +33,7 @@ func (p *CachingProperties) removePageMetadata(key []byte) (*PageMetadata, error
 		meta *PageMetadata
 	)
 
-	err := p.db.Update(func(tx *bolt.Tx) error {
+	err := p.DB().Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(key)
 		if b == nil {
 			return errors.New("there's no page to delete")
@@ -0,0 +1,88 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pelageech/BDUTS/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME gets and renews the certificates of the configured domains,
+// other server names are served from the store.
+type ACME struct {
+	manager *autocert.Manager
+	domains map[string]bool
+	store   *Store
+}
+
+// NewACME creates an ACME client keeping the certificates in cache.
+// store may be nil if all the certificates are taken through ACME.
+func NewACME(c *config.ACMEConfig, cache autocert.Cache, store *Store) (*ACME, error) {
+	if len(c.Domains) == 0 {
+		return nil, errors.New("no ACME domains are set")
+	}
+
+	client := &acme.Client{DirectoryURL: c.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates are found in " + c.CAFile)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}}
+	}
+
+	domains := make(map[string]bool, len(c.Domains))
+	for _, d := range c.Domains {
+		domains[strings.ToLower(d)] = true
+	}
+
+	return &ACME{
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       cache,
+			HostPolicy:  autocert.HostWhitelist(c.Domains...),
+			RenewBefore: time.Duration(c.RenewBefore) * time.Millisecond,
+			Client:      client,
+			Email:       c.Email,
+		},
+		domains: domains,
+		store:   store,
+	}, nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. It answers TLS-ALPN-01 challenges
+// and returns the certificates of ACME domains, getting them on the first request.
+func (a *ACME) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if a.domains[name] || a.store == nil || isChallenge(hello) {
+		return a.manager.GetCertificate(hello)
+	}
+	return a.store.GetCertificate(hello)
+}
+
+// HTTPHandler answers HTTP-01 challenges, other requests are passed to fallback.
+// If fallback is nil, they are redirected to HTTPS.
+func (a *ACME) HTTPHandler(fallback http.Handler) http.Handler {
+	return a.manager.HTTPHandler(fallback)
+}
+
+func isChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
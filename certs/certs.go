@@ -0,0 +1,326 @@
+// Package certs keeps the TLS certificates of the load balancer,
+// chooses them by SNI and reloads them when the files change.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// The files of a certificate in the directory are either <name>.crt and <name>.key
+// or <name>/fullchain.pem and <name>/privkey.pem like certbot makes them.
+const (
+	certExt = ".crt"
+	keyExt  = ".key"
+
+	chainFile      = "fullchain.pem"
+	privateKeyFile = "privkey.pem"
+)
+
+var logger = log.NewWithOptions(os.Stderr, log.Options{
+	ReportTimestamp: true,
+	ReportCaller:    true,
+})
+
+func LoggerConfig(prefix string) {
+	logger.SetPrefix(prefix)
+}
+
+// Info describes a loaded certificate for the admin API.
+type Info struct {
+	File      string
+	Names     []string
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// pair is the files of a certificate and its private key.
+type pair struct {
+	certFile string
+	keyFile  string
+}
+
+// fileState is used for detecting changes of the files.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+type entry struct {
+	pair  pair
+	cert  *tls.Certificate
+	names []string
+	info  Info
+}
+
+// Store is a set of certificates loaded from the default pair and a directory.
+type Store struct {
+	defaultPair pair
+	dir         string
+
+	mux      sync.RWMutex
+	entries  []*entry
+	byName   map[string]*entry
+	fallback *entry
+	files    map[string]fileState
+}
+
+// NewStore loads the default pair of files and the certificates from dir.
+// dir may be empty. The store may be empty if the certificates are taken through ACME.
+func NewStore(certFile, keyFile, dir string) *Store {
+	s := &Store{
+		defaultPair: pair{certFile: certFile, keyFile: keyFile},
+		dir:         dir,
+	}
+	s.reload()
+	return s
+}
+
+// Empty checks if no certificate is loaded.
+func (s *Store) Empty() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return len(s.entries) == 0
+}
+
+// GetCertificate chooses the certificate by the server name of ClientHello,
+// it's used as tls.Config.GetCertificate. Exact names are preferred to wildcards.
+// If no certificate matches, the default one is returned.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if e, ok := s.byName[name]; ok {
+		return e.cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if e, ok := s.byName["*"+name[i:]]; ok {
+			return e.cert, nil
+		}
+	}
+	if s.fallback == nil {
+		return nil, errors.New("no certificates are loaded")
+	}
+	return s.fallback.cert, nil
+}
+
+// Certificates returns the information about the loaded certificates.
+func (s *Store) Certificates() []Info {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	infos := make([]Info, 0, len(s.entries))
+	for _, e := range s.entries {
+		infos = append(infos, e.info)
+	}
+	return infos
+}
+
+// CertificatesHandler returns the loaded certificates with their expiry dates.
+func (s *Store) CertificatesHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, "Only GET requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := json.Marshal(s.Certificates())
+	if err != nil {
+		http.Error(rw, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if _, err := rw.Write(b); err != nil {
+		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// Watch checks the files every period and reloads the certificates if they change
+// until ctx is done.
+func (s *Store) Watch(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.changed() {
+			logger.Info("Certificate files have changed, reloading")
+			s.reload()
+		}
+	}
+}
+
+// changed checks if the set of files or any of their modification times differ.
+func (s *Store) changed() bool {
+	files := stat(s.pairs())
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if len(files) != len(s.files) {
+		return true
+	}
+	for name, state := range files {
+		if old, ok := s.files[name]; !ok || old != state {
+			return true
+		}
+	}
+	return false
+}
+
+// reload loads all the pairs. If a pair fails, its previous version is kept.
+func (s *Store) reload() {
+	pairs := s.pairs()
+	files := stat(pairs)
+
+	s.mux.RLock()
+	previous := make(map[pair]*entry, len(s.entries))
+	for _, e := range s.entries {
+		previous[e.pair] = e
+	}
+	s.mux.RUnlock()
+
+	entries := make([]*entry, 0, len(pairs))
+	for _, p := range pairs {
+		e, err := load(p)
+		if err != nil {
+			logger.Errorf("Failed to load certificate %s: %v", p.certFile, err)
+			if old, ok := previous[p]; ok {
+				entries = append(entries, old)
+			}
+			continue
+		}
+		logger.Infof("Loaded certificate %s for %v, expires %s\n", p.certFile, e.names, e.info.NotAfter)
+		entries = append(entries, e)
+	}
+
+	byName := make(map[string]*entry)
+	var fallback *entry
+	for _, e := range entries {
+		for _, name := range e.names {
+			if _, ok := byName[name]; !ok {
+				byName[name] = e
+			}
+		}
+		if fallback == nil || e.pair == s.defaultPair {
+			fallback = e
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.files = files
+	if len(entries) == 0 {
+		logger.Error("No certificates are loaded, the previous ones are kept")
+		return
+	}
+	s.entries = entries
+	s.byName = byName
+	s.fallback = fallback
+}
+
+// pairs lists the default pair if it exists and the pairs in the directory.
+func (s *Store) pairs() []pair {
+	var pairs []pair
+	if exists(s.defaultPair.certFile) && exists(s.defaultPair.keyFile) {
+		pairs = append(pairs, s.defaultPair)
+	}
+	if s.dir == "" {
+		return pairs
+	}
+
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		logger.Errorf("Failed to read certificates directory: %v", err)
+		return pairs
+	}
+
+	var found []pair
+	for _, d := range dirEntries {
+		path := filepath.Join(s.dir, d.Name())
+		var p pair
+		switch {
+		case d.IsDir():
+			p = pair{certFile: filepath.Join(path, chainFile), keyFile: filepath.Join(path, privateKeyFile)}
+		case strings.HasSuffix(d.Name(), certExt):
+			p = pair{certFile: path, keyFile: strings.TrimSuffix(path, certExt) + keyExt}
+		default:
+			continue
+		}
+		if exists(p.certFile) && exists(p.keyFile) && p != s.defaultPair {
+			found = append(found, p)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].certFile < found[j].certFile
+	})
+	return append(pairs, found...)
+}
+
+func load(p pair) (*entry, error) {
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+
+	dnsNames := leaf.DNSNames
+	if len(dnsNames) == 0 && leaf.Subject.CommonName != "" {
+		dnsNames = []string{leaf.Subject.CommonName}
+	}
+	names := make([]string, 0, len(dnsNames))
+	for _, name := range dnsNames {
+		names = append(names, strings.ToLower(name))
+	}
+
+	return &entry{
+		pair:  p,
+		cert:  &cert,
+		names: names,
+		info: Info{
+			File:      p.certFile,
+			Names:     names,
+			Issuer:    leaf.Issuer.String(),
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+		},
+	}, nil
+}
+
+func stat(pairs []pair) map[string]fileState {
+	files := make(map[string]fileState)
+	for _, p := range pairs {
+		for _, name := range []string{p.certFile, p.keyFile} {
+			if fi, err := os.Stat(name); err == nil {
+				files[name] = fileState{modTime: fi.ModTime(), size: fi.Size()}
+			}
+		}
+	}
+	return files
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
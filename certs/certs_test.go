@@ -0,0 +1,115 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for the names valid until notAfter.
+func writeCert(t *testing.T, certFile, keyFile string, notAfter time.Time, names ...string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serverNameOf(t *testing.T, s *Store, serverName string) string {
+	t.Helper()
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.DNSNames[0]
+}
+
+func TestStore(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "certs")
+	expiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+
+	writeCert(t, filepath.Join(root, "fullchain.pem"), filepath.Join(root, "privkey.pem"), expiry, "default.test")
+	writeCert(t, filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key"), expiry, "api.example.com")
+	writeCert(t, filepath.Join(dir, "wild", chainFile), filepath.Join(dir, "wild", privateKeyFile), expiry, "*.example.com")
+
+	s := NewStore(filepath.Join(root, "fullchain.pem"), filepath.Join(root, "privkey.pem"), dir)
+
+	for serverName, expected := range map[string]string{
+		"api.example.com": "api.example.com",
+		"API.example.com": "api.example.com",
+		"www.example.com": "*.example.com",
+		"a.b.example.com": "default.test",
+		"":                "default.test",
+	} {
+		if got := serverNameOf(t, s, serverName); got != expected {
+			t.Errorf("%q: expected certificate for %s, got %s", serverName, expected, got)
+		}
+	}
+
+	infos := s.Certificates()
+	if len(infos) != 3 {
+		t.Fatalf("expected 3 certificates, got %d", len(infos))
+	}
+	if !infos[0].NotAfter.Equal(expiry) {
+		t.Errorf("expected expiry %s, got %s", expiry, infos[0].NotAfter)
+	}
+
+	// the certificate is renewed, a new one is added
+	renewed := expiry.Add(24 * time.Hour)
+	writeCert(t, filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key"), renewed, "api.example.com")
+	writeCert(t, filepath.Join(dir, "shop.crt"), filepath.Join(dir, "shop.key"), renewed, "shop.test")
+	// the modification time may have the same second on some file systems
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(filepath.Join(dir, "api.crt"), future, future)
+
+	if !s.changed() {
+		t.Fatal("expected the change to be detected")
+	}
+	s.reload()
+
+	if got := serverNameOf(t, s, "shop.test"); got != "shop.test" {
+		t.Errorf("expected the new certificate to be used, got %s", got)
+	}
+	cert, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+	if !cert.Leaf.NotAfter.Equal(renewed) {
+		t.Errorf("expected the renewed certificate, expiry %s, got %s", renewed, cert.Leaf.NotAfter)
+	}
+	if s.changed() {
+		t.Error("expected no changes after reload")
+	}
+}
@@ -0,0 +1,18 @@
+package config
+
+// ACMEConfig is a struct for getting certificates of Domains through ACME.
+// DirectoryURL is Let's Encrypt by default, CAFile is a CA trusted for reaching
+// the directory, e.g. the one of a local Pebble instance.
+type ACMEConfig struct {
+	DirectoryURL string
+	Email        string
+	Domains      []string
+	CAFile       string
+
+	// HTTPPort is a port for HTTP-01 challenges. If it's 0, only TLS-ALPN-01
+	// is used, it's answered on the load balancer's port.
+	HTTPPort int
+
+	// RenewBefore is how long before expiry the certificates are renewed, in milliseconds.
+	RenewBefore int64
+}
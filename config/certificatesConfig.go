@@ -0,0 +1,10 @@
+package config
+
+// CertificatesConfig is a struct for the TLS certificates chosen by SNI.
+// Directory contains pairs <name>.crt and <name>.key or subdirectories
+// with fullchain.pem and privkey.pem. The files are checked every ReloadPeriod
+// milliseconds and reloaded when they change.
+type CertificatesConfig struct {
+	Directory    string
+	ReloadPeriod int64
+}
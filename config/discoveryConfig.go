@@ -0,0 +1,24 @@
+package config
+
+// DiscoveryConfig is a struct for service discovery config.
+// The registry is polled by HTTP and must return a JSON list of instances.
+type DiscoveryConfig struct {
+	// URL is the registry endpoint, e.g. http://consul:8500/v1/catalog/service/web.
+	URL string
+
+	// PollPeriod is a period of polling the registry in milliseconds.
+	PollPeriod int64
+
+	// WaitTime is how long the registry may hold a long-poll request, in milliseconds.
+	// Zero turns long-polling off.
+	WaitTime int64
+
+	// Scheme is used for instances given as an address and a port.
+	Scheme string
+
+	// HealthCheckTcpTimeout and MaximalRequests are applied to instances
+	// that don't set them.
+	HealthCheckTcpTimeout int64
+	MaximalRequests       int32
+	TLS                   *UpstreamTLSConfig
+}
@@ -0,0 +1,20 @@
+package config
+
+// DownstreamConfig limits the client connections of the HTTP listeners.
+// The timeouts are in milliseconds, zero means the default: 10 seconds for
+// ReadHeaderTimeout, 2 minutes for IdleTimeout and no limit for ReadTimeout
+// and WriteTimeout. Zero MaxConnections or MaxConnectionsPerIP means no limit.
+type DownstreamConfig struct {
+	ReadHeaderTimeout int64
+	ReadTimeout       int64
+	WriteTimeout      int64
+	IdleTimeout       int64
+
+	// MaxHeaderBytes is the maximal size of the request line and headers, 1 MiB by default.
+	MaxHeaderBytes int
+
+	// MaxConnections is the maximal number of open connections of all the listeners together,
+	// MaxConnectionsPerIP is the one of each client address. See also ListenerConfig.MaxConnections.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+}
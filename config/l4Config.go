@@ -0,0 +1,44 @@
+package config
+
+// TCPProxyConfig is a struct for a listener balancing raw TCP connections
+// between its own servers. The servers use URLs like tcp://10.0.0.1:5432,
+// MaximalRequests limits the connections to a server.
+type TCPProxyConfig struct {
+	Port    int
+	Servers []ServerConfig
+
+	// HealthCheckPeriod is set in milliseconds, the period of the load balancer is used by default.
+	HealthCheckPeriod int64
+
+	// IdleTimeout closes connections without traffic in both directions, in milliseconds.
+	IdleTimeout int64
+}
+
+// UDPProxyConfig is a struct for a listener balancing UDP datagrams
+// between its own servers. The servers use URLs like udp://10.0.0.1:53,
+// MaximalRequests limits the client sessions of a server.
+type UDPProxyConfig struct {
+	Port    int
+	Servers []ServerConfig
+
+	// HealthCheckPeriod is set in milliseconds, the period of the load balancer is used by default.
+	HealthCheckPeriod int64
+
+	// SessionTimeout removes the session of a client address which hasn't sent
+	// or received datagrams for this time, in milliseconds.
+	SessionTimeout int64
+}
+
+// PassthroughConfig is a struct for routing TLS connections by SNI to servers
+// terminating TLS themselves. The connections are accepted by the main listener
+// and aren't decrypted. ServerNames may contain wildcards like *.example.com.
+type PassthroughConfig struct {
+	ServerNames []string
+	Servers     []ServerConfig
+
+	// HealthCheckPeriod is set in milliseconds, the period of the load balancer is used by default.
+	HealthCheckPeriod int64
+
+	// IdleTimeout closes connections without traffic in both directions, in milliseconds.
+	IdleTimeout int64
+}
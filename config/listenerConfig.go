@@ -0,0 +1,31 @@
+package config
+
+// ListenerConfig is a struct for an address the load balancer listens on.
+// Purposes are "proxy", "admin" and "metrics".
+type ListenerConfig struct {
+	Address  string
+	TLS      bool
+	Purposes []string
+
+	// RedirectToHTTPS makes a plain-HTTP listener redirect the requests to HTTPS.
+	// HTTPSPort is the port of the redirect, 443 by default.
+	RedirectToHTTPS bool
+	HTTPSPort       int
+
+	// ClientCAFile is a CA bundle for verifying client certificates of a TLS listener.
+	// ClientAuth is "require" (default) or "optional", an optional certificate
+	// is verified if it's sent and may be required by a route.
+	ClientCAFile string
+	ClientAuth   string
+
+	// ACMEChallenges makes a plain-HTTP listener answer ACME HTTP-01 challenges.
+	ACMEChallenges bool
+
+	// ProxyProtocol makes the listener read PROXY protocol headers even if
+	// it doesn't serve the proxy, see LoadBalancerConfig.ProxyProtocol.
+	ProxyProtocol bool
+
+	// MaxConnections is the maximal number of open connections of the listener alone,
+	// it's checked in addition to DownstreamConfig.MaxConnections. Zero means no limit.
+	MaxConnections int
+}
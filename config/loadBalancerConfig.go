@@ -13,10 +13,67 @@ type LoadBalancerReader struct {
 
 // LoadBalancerConfig is a struct for load balancer config.
 type LoadBalancerConfig struct {
+	// Port is used if Listeners aren't set, the proxy and the admin API
+	// are served there over TLS and the metrics are served on :8081.
 	Port              int
 	HealthCheckPeriod int64
 	MaxCacheSize      int64
 	ObserveFrequency  int64
+
+	// MaxCacheableResponseSize is the maximal size of a response body in bytes
+	// which is saved in cache. Default is 10 MiB.
+	MaxCacheableResponseSize int64
+
+	Listeners []ListenerConfig
+
+	// ShutdownTimeout is how long the requests in flight are waited for on SIGTERM, in milliseconds.
+	ShutdownTimeout int64
+
+	// Downstream sets the timeouts and the connection limits of the listeners.
+	Downstream *DownstreamConfig
+
+	// LoadShedding rejects low priority requests when the balancer is overloaded.
+	LoadShedding *LoadSheddingConfig
+
+	// RateLimits are checked for each request, all of them must allow it.
+	// RateLimitJWT verifies the tokens of the limits by JWT subject.
+	RateLimits   []RateLimitConfig
+	RateLimitJWT *RateLimitJWTConfig
+
+	Discovery  *DiscoveryConfig
+	Routes     []RouteConfig
+	TCPProxies []TCPProxyConfig
+	UDPProxies []UDPProxyConfig
+
+	// Passthrough routes TLS connections to the pools chosen by SNI without decrypting.
+	Passthrough []PassthroughConfig
+
+	// H2C lets clients use HTTP/2 over plain-text connections.
+	// HTTP/2 over TLS is always available.
+	H2C bool
+
+	// ProxyProtocol makes the listeners serving the proxy read PROXY protocol v1/v2 headers,
+	// other listeners read them if their own ProxyProtocol is set.
+	// If TrustedProxies is set, the headers are read only from them.
+	ProxyProtocol bool
+
+	// TrustedProxies is a list of CIDRs or addresses of the proxies
+	// whose X-Forwarded-For is used for finding the client address.
+	TrustedProxies []string
+
+	// ClientCertSubjectHeader and ClientCertSANsHeader are the headers with the verified
+	// client certificate sent to the backends, X-Client-Cert-Subject and X-Client-Cert-SANs by default.
+	ClientCertSubjectHeader string
+	ClientCertSANsHeader    string
+
+	// Certificates are used in addition to resources/fullchain.pem and resources/privkey.pem.
+	Certificates *CertificatesConfig
+
+	// ACME gets and renews certificates of its domains automatically.
+	ACME *ACMEConfig
+
+	// UpstreamTLS is used for the backends which don't have their own TLS settings.
+	UpstreamTLS *UpstreamTLSConfig
 }
 
 // NewLoadBalancerReader is a constructor for LoadBalancerReader.
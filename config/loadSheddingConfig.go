@@ -0,0 +1,24 @@
+package config
+
+// LoadSheddingConfig is a struct for rejecting requests when the balancer is overloaded.
+// The load is the largest ratio of CPU usage in percent, the number of goroutines and
+// the number of requests in flight to their thresholds, zero thresholds aren't checked.
+// Low priority requests are rejected first, critical ones are never rejected.
+type LoadSheddingConfig struct {
+	CPU        float64
+	Goroutines int
+	QueueDepth int
+
+	// PriorityHeader is the header with the priority set by a trusted proxy in front.
+	PriorityHeader string
+
+	// Clients set the priority of the requests by the client address.
+	Clients []ClientPriorityConfig
+}
+
+// ClientPriorityConfig is a struct for the priority of the clients with Addresses,
+// each of them is a CIDR or a single IP address.
+type ClientPriorityConfig struct {
+	Addresses []string
+	Priority  string
+}
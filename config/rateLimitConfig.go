@@ -0,0 +1,35 @@
+package config
+
+// RateLimitConfig is a struct for a token bucket limit of requests.
+type RateLimitConfig struct {
+	// Path limits only the requests whose path starts with it, empty means all the requests.
+	Path string
+
+	// Key is what the requests are counted by: "ip" of the client, "route" for all
+	// the requests of Path together, "jwt" subject or "header:<name>", e.g. "header:X-API-Key".
+	// The JWT is verified by RateLimitJWTConfig. The header isn't checked, so its values
+	// must be validated in front of the balancer, otherwise a client gets a new bucket with each value.
+	// The requests without a valid JWT or the header are counted by the client address.
+	Key string
+
+	// Rate is the number of requests per second, Burst is the number of requests at once.
+	Rate  float64
+	Burst int
+}
+
+// RateLimitJWTConfig is a struct for verifying the tokens of the rate limits by JWT subject.
+// The tokens are issued for the clients, so the key isn't JWT_SIGNING_KEY of the admin API.
+// Either KeyFile or JWKSURL must be set.
+type RateLimitJWTConfig struct {
+	// KeyFile is an HMAC secret or a PEM public key (RSA, ECDSA or Ed25519).
+	// The trailing newline of the secret is ignored.
+	KeyFile string
+
+	// JWKSURL is a JSON Web Key Set, the key is chosen by "kid" of the token.
+	// The set is fetched every RefreshPeriod milliseconds, 5 minutes by default.
+	JWKSURL       string
+	RefreshPeriod int64
+
+	// Algorithms are the allowed "alg" of the tokens, e.g. ["RS256", "ES256"].
+	Algorithms []string
+}
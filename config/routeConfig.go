@@ -0,0 +1,42 @@
+package config
+
+// RouteConfig is a struct for settings of requests whose path starts with Path.
+// The longest matching Path is used, Path "/" sets defaults for all the requests.
+type RouteConfig struct {
+	Path string
+
+	// MaxBodySize is the maximal size of a request body in bytes, 0 means no limit.
+	MaxBodySize int64
+
+	// RequireClientCert rejects the requests without a verified client certificate.
+	// The listener must request the certificates, see ListenerConfig.ClientAuth.
+	RequireClientCert bool
+
+	// ClientCAFile is a CA bundle the client certificate of the route must be issued by,
+	// it implies RequireClientCert. The CAs must be trusted by the listener as well.
+	ClientCAFile string
+
+	// Timeout limits the whole request including retries, TryTimeout limits
+	// each request to a backend. Both are in milliseconds, zero means no limit.
+	Timeout    int64
+	TryTimeout int64
+
+	// Hedging sends a copy of a GET or HEAD request to another backend
+	// if the first one hasn't responded in time.
+	Hedging *HedgingConfig
+
+	// Priority is "critical", "high", "normal" or "low", see LoadSheddingConfig.
+	Priority string
+}
+
+// HedgingConfig is a struct for settings of hedged requests.
+type HedgingConfig struct {
+	// Delay is how long the first backend is waited for, in milliseconds.
+	// If Quantile is set, the observed quantile of the response time is used
+	// instead when there are enough samples.
+	Delay    int64
+	Quantile float64
+
+	// Budget is the maximal share of the hedged requests in percent, 10 by default.
+	Budget float64
+}
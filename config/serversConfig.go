@@ -16,6 +16,71 @@ type ServerConfig struct {
 	URL                   string
 	HealthCheckTcpTimeout int64
 	MaximalRequests       int32
+
+	// Transport settings, the timeouts are set in milliseconds.
+	// Zero values mean defaults.
+	DialTimeout           int64
+	TLSHandshakeTimeout   int64
+	ResponseHeaderTimeout int64
+	IdleConnTimeout       int64
+	KeepAlive             int64
+	MaxIdleConnsPerHost   int
+	DisableKeepAlives     bool
+
+	// Timeout limits each request to the backend including the response body,
+	// in milliseconds. Zero means no limit.
+	Timeout int64
+
+	// HTTP2 lets the connection use HTTP/2 negotiated by TLS ALPN,
+	// H2C makes BDUTS speak HTTP/2 over plain-text connections (prior knowledge).
+	HTTP2 bool
+	H2C   bool
+
+	// ProxyProtocol makes BDUTS send a PROXY protocol v2 header with
+	// the client address on each connection. Keep-alives are disabled then
+	// because a connection can't be shared by different clients,
+	// for the same reason it can't be combined with H2C.
+	ProxyProtocol bool
+
+	// TLS is used for connections to the backend with https scheme.
+	TLS *UpstreamTLSConfig
+
+	// ConcurrencyLimit makes the limit of concurrent requests adaptive,
+	// MaximalRequests is its initial value then.
+	ConcurrencyLimit *ConcurrencyLimitConfig
+}
+
+// ConcurrencyLimitConfig is a struct for settings of an adaptive concurrency limit.
+type ConcurrencyLimitConfig struct {
+	// Algorithm is "aimd" or "gradient".
+	Algorithm string
+
+	// MinLimit and MaxLimit bound the limit, 1 and 1000 by default.
+	MinLimit int
+	MaxLimit int
+
+	// LatencyThreshold is the response time in milliseconds above which
+	// AIMD decreases the limit as on a failure. Zero means only failures decrease it.
+	LatencyThreshold int64
+}
+
+// UpstreamTLSConfig is a struct for TLS settings of connections to a backend.
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM bundle for verifying the backend certificate.
+	// The system roots are used if it's empty.
+	CAFile string
+
+	// CertFile and KeyFile are a client certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+
+	// ServerName overrides the name used for SNI and verification.
+	ServerName string
+
+	// MinVersion is one of "1.0", "1.1", "1.2", "1.3". Default is "1.2".
+	MinVersion string
+
+	InsecureSkipVerify bool
 }
 
 // NewServersReader is a constructor for ServersReader.
@@ -0,0 +1,225 @@
+// Package connlimit limits the number of concurrent client connections
+// of all the listeners in total and per client address, and of each listener.
+package connlimit
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/pelageech/BDUTS/metrics"
+)
+
+const (
+	reasonTotal    = "max_connections"
+	reasonListener = "max_listener_connections"
+	reasonPerIP    = "max_connections_per_ip"
+)
+
+// ErrTooManyConnections is returned from Read and Write of a connection
+// rejected because its client has too many connections.
+var ErrTooManyConnections = errors.New("too many connections from the client")
+
+// Limits are the limits of the connections shared by the listeners:
+// the total number of open connections and the number per client address.
+type Limits struct {
+	max      int
+	maxPerIP int
+
+	mux   sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// NewLimits creates the shared limits. Zero max or maxPerIP means no limit.
+func NewLimits(max, maxPerIP int) *Limits {
+	return &Limits{
+		max:      max,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+	}
+}
+
+// Open returns the number of open connections of all the listeners.
+func (l *Limits) Open() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.total
+}
+
+// acquire takes a slot of the total limit.
+func (l *Limits) acquire() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		return false
+	}
+	l.total++
+	return true
+}
+
+// admit takes a slot of the client address.
+func (l *Limits) admit(ip string) bool {
+	if l.maxPerIP <= 0 {
+		return true
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.perIP[ip]++
+	return true
+}
+
+func (l *Limits) release(ip string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.total--
+	if ip == "" {
+		return
+	}
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// Listener closes the accepted connections over its own limit or the shared ones.
+// The limit per address is checked at the first Read or Write,
+// so the address may be taken from a PROXY header without blocking Accept.
+type Listener struct {
+	net.Listener
+
+	name   string
+	max    int
+	limits *Limits
+
+	mux  sync.Mutex
+	open int
+}
+
+// NewListener wraps ln, name is used in the metrics. max is the limit of the listener alone,
+// zero means no limit. limits may be shared by several listeners, nil means no shared limits.
+func NewListener(ln net.Listener, name string, max int, limits *Limits) *Listener {
+	if limits == nil {
+		limits = NewLimits(0, 0)
+	}
+	return &Listener{
+		Listener: ln,
+		name:     name,
+		max:      max,
+		limits:   limits,
+	}
+}
+
+// Accept waits for and returns the next connection under the total limits.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if reason := l.acquire(); reason != "" {
+			_ = conn.Close()
+			metrics.UpdateRejectedConnections(l.name, reason)
+			continue
+		}
+
+		metrics.UpdateDownstreamConnections(l.name, 1)
+		return &Conn{Conn: conn, l: l}, nil
+	}
+}
+
+// Open returns the number of open connections of the listener.
+func (l *Listener) Open() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.open
+}
+
+// acquire takes a slot of the listener and a shared one,
+// it returns the reason of the rejection if there's no free slot.
+func (l *Listener) acquire() string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.max > 0 && l.open >= l.max {
+		return reasonListener
+	}
+	if !l.limits.acquire() {
+		return reasonTotal
+	}
+	l.open++
+	return ""
+}
+
+func (l *Listener) release(ip string) {
+	l.mux.Lock()
+	l.open--
+	l.mux.Unlock()
+	l.limits.release(ip)
+}
+
+// Conn frees its slots on Close.
+type Conn struct {
+	net.Conn
+	l *Listener
+
+	admitOnce sync.Once
+	ip        string
+	err       error
+
+	closeOnce sync.Once
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.admit(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.admit(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// CloseWrite lets the TCP proxy half-close the client connection.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		// the slot of the address is taken only by an admitted connection
+		c.admitOnce.Do(func() { c.err = net.ErrClosed })
+		c.l.release(c.ip)
+		metrics.UpdateDownstreamConnections(c.l.name, -1)
+	})
+	return c.Conn.Close()
+}
+
+func (c *Conn) admit() error {
+	c.admitOnce.Do(func() {
+		if c.l.limits.maxPerIP <= 0 {
+			return
+		}
+		ip := c.Conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		if !c.l.limits.admit(ip) {
+			c.err = ErrTooManyConnections
+			metrics.UpdateRejectedConnections(c.l.name, reasonPerIP)
+			_ = c.Conn.Close()
+			return
+		}
+		c.ip = ip
+	})
+	return c.err
+}
@@ -0,0 +1,159 @@
+package connlimit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/metrics"
+)
+
+func TestMain(m *testing.M) {
+	metrics.Init(0, 0)
+	m.Run()
+}
+
+func listen(t *testing.T, max int, limits *Limits) *Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(ln, "test", max, limits)
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+func dial(t *testing.T, l *Listener) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	l := listen(t, 0, NewLimits(0, 1))
+
+	dial(t, l)
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Write([]byte("x")); err != nil {
+		t.Fatalf("the first connection is rejected: %v", err)
+	}
+
+	dial(t, l)
+	second, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Read(make([]byte, 1)); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("expected ErrTooManyConnections, got %v", err)
+	}
+	_ = second.Close()
+
+	// the slot is freed when the first one is closed
+	_ = first.Close()
+	dial(t, l)
+	third, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if _, err := third.Write([]byte("x")); err != nil {
+		t.Fatalf("the connection after closing is rejected: %v", err)
+	}
+	if n := l.Open(); n != 1 {
+		t.Errorf("expected 1 open connection, got %d", n)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    int
+		limits *Limits
+	}{
+		{name: "shared", limits: NewLimits(1, 0)},
+		{name: "listener", max: 1, limits: NewLimits(10, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := listen(t, tt.max, tt.limits)
+
+			dial(t, l)
+			first, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the second connection is closed in Accept, which waits for the next one
+			rejected := dial(t, l)
+			accepted := acceptAsync(l)
+			expectClosed(t, rejected)
+
+			_ = first.Close()
+			dial(t, l)
+			select {
+			case conn := <-accepted:
+				_ = conn.Close()
+			case <-time.After(time.Second):
+				t.Fatal("the connection after closing isn't accepted")
+			}
+		})
+	}
+}
+
+// TestSharedMaxConnections checks that the total limit is shared by the listeners.
+func TestSharedMaxConnections(t *testing.T) {
+	limits := NewLimits(1, 0)
+	a := listen(t, 0, limits)
+	b := listen(t, 0, limits)
+
+	dial(t, a)
+	first, err := a.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := dial(t, b)
+	accepted := acceptAsync(b)
+	expectClosed(t, rejected)
+	if n := limits.Open(); n != 1 {
+		t.Errorf("expected 1 open connection of all the listeners, got %d", n)
+	}
+
+	_ = first.Close()
+	dial(t, b)
+	select {
+	case conn := <-accepted:
+		_ = conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("the connection of another listener isn't accepted after closing")
+	}
+}
+
+func acceptAsync(l *Listener) <-chan net.Conn {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	return accepted
+}
+
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeBucket keeps ACME account keys and certificates.
+const acmeBucket = "acme"
+
+// ACMECache is autocert.Cache storing the data in its own database,
+// so the user management can't reach it.
+type ACMECache struct {
+	mux  sync.RWMutex
+	db   *bolt.DB
+	path string
+	mode os.FileMode
+}
+
+// OpenACMECache opens the database of ACME certificates.
+func OpenACMECache(dbName string, mode os.FileMode, options *bolt.Options) (*ACMECache, error) {
+	db, err := bolt.Open(dbName, mode, options)
+	if err != nil {
+		return nil, err
+	}
+	return &ACMECache{db: db, path: dbName, mode: mode}, nil
+}
+
+// Close closes the database.
+func (c *ACMECache) Close() error {
+	return c.conn().Close()
+}
+
+// Reopen opens the closed database again.
+func (c *ACMECache) Reopen(options *bolt.Options) error {
+	db, err := bolt.Open(c.path, c.mode, options)
+	if err != nil {
+		return err
+	}
+	c.mux.Lock()
+	c.db = db
+	c.mux.Unlock()
+	return nil
+}
+
+// conn returns the database, it's changed by Reopen.
+func (c *ACMECache) conn() *bolt.DB {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.db
+}
+
+// Get returns autocert.ErrCacheMiss if there's no data for the key.
+func (c *ACMECache) Get(_ context.Context, key string) (data []byte, err error) {
+	err = c.conn().View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(acmeBucket))
+		if b == nil {
+			return autocert.ErrCacheMiss
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return autocert.ErrCacheMiss
+		}
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return
+}
+
+// Put saves the data for the key.
+func (c *ACMECache) Put(_ context.Context, key string, data []byte) error {
+	return c.conn().Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(acmeBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket \"%s\": %w", acmeBucket, err)
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Delete removes the data of the key.
+func (c *ACMECache) Delete(_ context.Context, key string) error {
+	return c.conn().Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(acmeBucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
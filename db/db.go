@@ -4,6 +4,7 @@ package db
 import (
 	"fmt"
 	"os"
+	"sync"
 
 	"github.com/boltdb/bolt"
 	"github.com/charmbracelet/log"
@@ -17,22 +18,43 @@ const (
 
 // Service is a service that interacts with the database.
 type Service struct {
+	mux    sync.RWMutex
 	db     *bolt.DB
+	path   string
+	mode   os.FileMode
 	logger *log.Logger
 }
 
 // Connect connects to the database.
-func (s *Service) Connect(dbName string, mode os.FileMode, options *bolt.Options) (err error) {
-	s.db, err = bolt.Open(dbName, mode, options)
-	return
+func (s *Service) Connect(dbName string, mode os.FileMode, options *bolt.Options) error {
+	db, err := bolt.Open(dbName, mode, options)
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	s.db, s.path, s.mode = db, dbName, mode
+	s.mux.Unlock()
+	return nil
 }
 
 // Close closes the database connection.
 func (s *Service) Close() (err error) {
-	err = s.db.Close()
+	err = s.conn().Close()
 	return
 }
 
+// Reopen connects to the closed database again.
+func (s *Service) Reopen(options *bolt.Options) error {
+	return s.Connect(s.path, s.mode, options)
+}
+
+// conn returns the database, it's changed by Reopen.
+func (s *Service) conn() *bolt.DB {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.db
+}
+
 // SetLogger sets the logger.
 func (s *Service) SetLogger(logger *log.Logger) {
 	s.logger = logger
@@ -40,7 +62,7 @@ func (s *Service) SetLogger(logger *log.Logger) {
 
 // InsertUser inserts a new user into the database.
 func (s *Service) InsertUser(username, salt, hash, email string) (err error) {
-	err = s.db.Update(func(tx *bolt.Tx) error {
+	err = s.conn().Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucket([]byte(username))
 		if err != nil {
 			return fmt.Errorf("create bucket \"%s\": %w", username, err)
@@ -64,7 +86,7 @@ func (s *Service) InsertUser(username, salt, hash, email string) (err error) {
 
 // GetSaltAndHash gets the salt and hash for a given username.
 func (s *Service) GetSaltAndHash(username string) (salt, hash string, err error) {
-	err = s.db.View(func(tx *bolt.Tx) error {
+	err = s.conn().View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(username))
 		if b == nil {
 			return fmt.Errorf("bucket \"%s\" does not exist", username)
@@ -78,7 +100,7 @@ func (s *Service) GetSaltAndHash(username string) (salt, hash string, err error)
 
 // ChangePassword changes the password for a given username.
 func (s *Service) ChangePassword(username, salt, hash string) (err error) {
-	err = s.db.Update(func(tx *bolt.Tx) error {
+	err = s.conn().Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(username))
 		if b == nil {
 			return fmt.Errorf("bucket \"%s\" does not exist", username)
@@ -98,7 +120,7 @@ func (s *Service) ChangePassword(username, salt, hash string) (err error) {
 
 // GetEmail gets the email address for a given username.
 func (s *Service) GetEmail(username string) (email string, err error) {
-	err = s.db.View(func(tx *bolt.Tx) error {
+	err = s.conn().View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(username))
 		if b == nil {
 			return fmt.Errorf("bucket \"%s\" does not exist", username)
@@ -111,7 +133,7 @@ func (s *Service) GetEmail(username string) (email string, err error) {
 
 // DeleteUser deletes an existing user from the database by username.
 func (s *Service) DeleteUser(username string) (err error) {
-	err = s.db.Update(func(tx *bolt.Tx) error {
+	err = s.conn().Update(func(tx *bolt.Tx) error {
 		err := tx.DeleteBucket([]byte(username))
 		if err != nil {
 			return fmt.Errorf("delete bucket \"%s\": %w", username, err)
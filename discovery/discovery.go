@@ -0,0 +1,96 @@
+// Package discovery implements service discovery providers
+// feeding backends into a server pool.
+package discovery
+
+import (
+	"context"
+	"os"
+	"sort"
+
+	"github.com/charmbracelet/log"
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+)
+
+var logger = log.NewWithOptions(os.Stderr, log.Options{
+	ReportTimestamp: true,
+	ReportCaller:    true,
+})
+
+func LoggerConfig(prefix string) {
+	logger.SetPrefix(prefix)
+}
+
+// Discoverer is a source of backends for the server pool.
+type Discoverer interface {
+	// Watch sends the full list of discovered servers to updates
+	// every time the list changes. It blocks until ctx is done
+	// or an unrecoverable error occurs.
+	Watch(ctx context.Context, updates chan<- []config.ServerConfig) error
+}
+
+// Run applies updates of the Discoverer to the pool until ctx is done.
+// Only the servers added by Run are removed from the pool when they disappear
+// from the Discoverer, so the servers added by hand or from config are untouched.
+// onAdd is called for each new backend, it's usually the health check function.
+func Run(ctx context.Context, d Discoverer, pool *backend.ServerPool, onAdd func(*backend.Backend)) error {
+	updates := make(chan []config.ServerConfig)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- d.Watch(ctx, updates)
+	}()
+
+	known := make(map[string]struct{})
+	for {
+		select {
+		case servers := <-updates:
+			apply(pool, servers, known, onAdd)
+		case err := <-errChan:
+			return err
+		}
+	}
+}
+
+// apply adds new servers to the pool and removes the ones that were
+// discovered before but are missing now.
+func apply(pool *backend.ServerPool, servers []config.ServerConfig, known map[string]struct{}, onAdd func(*backend.Backend)) {
+	current := make(map[string]struct{}, len(servers))
+	for _, server := range servers {
+		b := pool.NewBackend(server)
+		if b == nil {
+			continue
+		}
+
+		url := b.URL().String()
+		current[url] = struct{}{}
+		if pool.FindServerByUrl(url) != nil {
+			continue
+		}
+
+		pool.AddServer(b)
+		known[url] = struct{}{}
+		if onAdd != nil {
+			onAdd(b)
+		}
+	}
+
+	for url := range known {
+		if _, ok := current[url]; ok {
+			continue
+		}
+		if err := pool.RemoveServerByUrl(url); err != nil {
+			logger.Warnf("[%s] couldn't be removed: %v", url, err)
+		}
+		delete(known, url)
+	}
+}
+
+// urls returns the sorted URLs of the servers, it's used for comparing lists.
+func urls(servers []config.ServerConfig) []string {
+	result := make([]string, 0, len(servers))
+	for _, s := range servers {
+		result = append(result, s.URL)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,142 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+)
+
+// fakeRegistry is a registry returning a list of instances in Consul catalog format.
+type fakeRegistry struct {
+	mux       sync.Mutex
+	instances []instance
+	etag      string
+	notMod    int
+}
+
+func (f *fakeRegistry) set(etag string, instances ...instance) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.etag = etag
+	f.instances = instances
+}
+
+func (f *fakeRegistry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if req.Header.Get("If-None-Match") == f.etag {
+		f.notMod++
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.Header().Set("ETag", f.etag)
+	_ = json.NewEncoder(rw).Encode(f.instances)
+}
+
+func TestHTTPRegistryFetch(t *testing.T) {
+	fake := &fakeRegistry{}
+	fake.set(`"1"`,
+		instance{Address: "10.0.0.1", ServicePort: 8080},
+		instance{Address: "10.0.0.1", ServiceAddress: "10.0.0.2", ServicePort: 9090},
+		instance{URL: "https://10.0.0.3:443", MaximalRequests: 3},
+	)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	r := NewHTTPRegistry(&config.DiscoveryConfig{URL: srv.URL, MaximalRequests: 7})
+
+	servers, changed, err := r.fetch(context.Background())
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if !changed {
+		t.Fatal("expected the first fetch to report a change")
+	}
+
+	expected := []config.ServerConfig{
+		{URL: "http://10.0.0.1:8080", HealthCheckTcpTimeout: defaultHealthCheckTcpTimeout, MaximalRequests: 7},
+		{URL: "http://10.0.0.2:9090", HealthCheckTcpTimeout: defaultHealthCheckTcpTimeout, MaximalRequests: 7},
+		{URL: "https://10.0.0.3:443", HealthCheckTcpTimeout: defaultHealthCheckTcpTimeout, MaximalRequests: 3},
+	}
+	if len(servers) != len(expected) {
+		t.Fatalf("expected %d servers, got %d", len(expected), len(servers))
+	}
+	for i := range expected {
+		if servers[i] != expected[i] {
+			t.Errorf("server %d: expected %+v, got %+v", i, expected[i], servers[i])
+		}
+	}
+
+	_, changed, err = r.fetch(context.Background())
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if changed || fake.notMod != 1 {
+		t.Errorf("expected 304 Not Modified to be used, changed=%v notModified=%d", changed, fake.notMod)
+	}
+}
+
+func TestRun(t *testing.T) {
+	fake := &fakeRegistry{}
+	fake.set(`"1"`, instance{URL: "http://10.0.0.1:80"}, instance{URL: "http://10.0.0.2:80"})
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	pool := backend.NewServerPool()
+	pool.AddServer(backend.NewBackend(mustParse(t, "http://10.0.0.9:80"), time.Second, 1))
+
+	r := NewHTTPRegistry(&config.DiscoveryConfig{URL: srv.URL, PollPeriod: 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = Run(ctx, r, pool, nil)
+	}()
+
+	waitForPool(t, pool, "http://10.0.0.1:80", "http://10.0.0.2:80", "http://10.0.0.9:80")
+
+	fake.set(`"2"`, instance{URL: "http://10.0.0.2:80"}, instance{URL: "http://10.0.0.3:80"})
+	waitForPool(t, pool, "http://10.0.0.2:80", "http://10.0.0.3:80", "http://10.0.0.9:80")
+}
+
+func waitForPool(t *testing.T, pool *backend.ServerPool, expected ...string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		pool.Lock()
+		got := make([]config.ServerConfig, 0, len(pool.Servers()))
+		for _, s := range pool.Servers() {
+			got = append(got, config.ServerConfig{URL: s.URL().String()})
+		}
+		pool.Unlock()
+
+		u := urls(got)
+		if len(u) == len(expected) {
+			same := true
+			for i := range u {
+				same = same && u[i] == expected[i]
+			}
+			if same {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("pool doesn't match %v", expected)
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
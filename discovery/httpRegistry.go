@@ -0,0 +1,203 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/pelageech/BDUTS/config"
+)
+
+const (
+	// indexHeader is the header used by Consul for blocking queries.
+	indexHeader = "X-Consul-Index"
+
+	defaultPollPeriod            = 10 * time.Second
+	defaultScheme                = "http"
+	defaultHealthCheckTcpTimeout = 1000
+	defaultMaximalRequests       = 10
+
+	// the registry may answer a bit later than the wait time
+	longPollSlack = 5 * time.Second
+)
+
+// instance is an item of the list returned by the registry.
+// Both the native format (URL, ...) and the Consul catalog
+// format (Address, ServiceAddress, ServicePort) are supported.
+type instance struct {
+	URL                   string
+	HealthCheckTcpTimeout int64
+	MaximalRequests       int32
+
+	Address        string
+	ServiceAddress string
+	ServicePort    int
+}
+
+// HTTPRegistry is a Discoverer polling an HTTP endpoint that returns
+// a JSON list of instances. It uses ETag and, if the registry sends
+// X-Consul-Index, long-polling for not downloading the same list again.
+type HTTPRegistry struct {
+	client     *http.Client
+	url        string
+	pollPeriod time.Duration
+	waitTime   time.Duration
+	defaults   config.ServerConfig
+	scheme     string
+
+	etag  string
+	index string
+}
+
+// NewHTTPRegistry creates a new HTTPRegistry from config.DiscoveryConfig.
+func NewHTTPRegistry(c *config.DiscoveryConfig) *HTTPRegistry {
+	pollPeriod := time.Duration(c.PollPeriod) * time.Millisecond
+	if pollPeriod <= 0 {
+		pollPeriod = defaultPollPeriod
+	}
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = defaultScheme
+	}
+	waitTime := time.Duration(c.WaitTime) * time.Millisecond
+	healthCheckTimeout := c.HealthCheckTcpTimeout
+	if healthCheckTimeout <= 0 {
+		healthCheckTimeout = defaultHealthCheckTcpTimeout
+	}
+	maxRequests := c.MaximalRequests
+	if maxRequests <= 0 {
+		maxRequests = defaultMaximalRequests
+	}
+
+	return &HTTPRegistry{
+		client:     &http.Client{Timeout: waitTime + longPollSlack},
+		url:        c.URL,
+		pollPeriod: pollPeriod,
+		waitTime:   waitTime,
+		defaults: config.ServerConfig{
+			HealthCheckTcpTimeout: healthCheckTimeout,
+			MaximalRequests:       maxRequests,
+			TLS:                   c.TLS,
+		},
+		scheme: scheme,
+	}
+}
+
+// Watch polls the registry until ctx is done. The errors of polling
+// are logged and the registry is asked again after the poll period.
+func (r *HTTPRegistry) Watch(ctx context.Context, updates chan<- []config.ServerConfig) error {
+	var last []string
+	for {
+		servers, changed, err := r.fetch(ctx)
+		switch {
+		case errors.Is(err, context.Canceled):
+			return ctx.Err()
+		case err != nil:
+			logger.Warnf("Polling %s: %v", r.url, err)
+		case changed && !reflect.DeepEqual(urls(servers), last):
+			last = urls(servers)
+			select {
+			case updates <- servers:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// a blocking query returns by itself when the list changes
+		if err == nil && r.index != "" && r.waitTime > 0 {
+			continue
+		}
+
+		select {
+		case <-time.After(r.pollPeriod):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fetch makes a single request to the registry. It returns false
+// if the registry says the list is the same.
+func (r *HTTPRegistry) fetch(ctx context.Context) ([]config.ServerConfig, bool, error) {
+	u, err := url.Parse(r.url)
+	if err != nil {
+		return nil, false, err
+	}
+	if r.index != "" && r.waitTime > 0 {
+		q := u.Query()
+		q.Set("index", r.index)
+		q.Set("wait", strconv.FormatInt(r.waitTime.Milliseconds(), 10)+"ms")
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return nil, false, err
+	}
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, false, nil
+	case http.StatusOK:
+	default:
+		return nil, false, fmt.Errorf("registry returned %s", resp.Status)
+	}
+
+	var instances []instance
+	if err := json.NewDecoder(resp.Body).Decode(&instances); err != nil {
+		return nil, false, err
+	}
+
+	index := resp.Header.Get(indexHeader)
+	if index == r.index && r.index != "" {
+		return nil, false, nil
+	}
+	r.index = index
+	r.etag = resp.Header.Get("ETag")
+
+	servers := make([]config.ServerConfig, 0, len(instances))
+	for _, i := range instances {
+		servers = append(servers, r.serverConfig(i))
+	}
+	return servers, true, nil
+}
+
+func (r *HTTPRegistry) serverConfig(i instance) config.ServerConfig {
+	server := config.ServerConfig{
+		URL:                   i.URL,
+		HealthCheckTcpTimeout: i.HealthCheckTcpTimeout,
+		MaximalRequests:       i.MaximalRequests,
+		TLS:                   r.defaults.TLS,
+	}
+
+	if server.URL == "" {
+		host := i.ServiceAddress
+		if host == "" {
+			host = i.Address
+		}
+		server.URL = r.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(i.ServicePort))
+	}
+	if server.HealthCheckTcpTimeout <= 0 {
+		server.HealthCheckTcpTimeout = r.defaults.HealthCheckTcpTimeout
+	}
+	if server.MaximalRequests <= 0 {
+		server.MaximalRequests = r.defaults.MaximalRequests
+	}
+	return server
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pelageech/BDUTS/backend"
+)
+
+// On SIGUSR2 the listening sockets are inherited by a new process of the binary.
+// The keys of the sockets are passed in the environment variable in the order
+// of their descriptors, the first one is 3 as 0-2 are stdin, stdout and stderr.
+// The new process reports it's ready to the pipe passed after the sockets.
+const (
+	envInheritedSockets = "BDUTS_INHERITED_SOCKETS"
+	envReadyPipe        = "BDUTS_READY_PIPE"
+	firstInheritedFd    = 3
+	readyMessage        = "ready\n"
+
+	// handoffTimeout limits the start of the new process
+	handoffTimeout  = time.Minute
+	drainPollPeriod = 10 * time.Millisecond
+)
+
+// sockets keeps the listening sockets of the process for handing them off
+// and the sockets inherited from the previous process.
+type sockets struct {
+	mux       sync.Mutex
+	inherited map[string]*os.File
+	ready     *os.File
+	keys      []string
+	files     []*os.File
+}
+
+var listeningSockets = newSockets()
+
+// newSockets takes the inherited sockets from the environment.
+func newSockets() *sockets {
+	s := &sockets{inherited: make(map[string]*os.File)}
+	env := os.Getenv(envInheritedSockets)
+	if env == "" {
+		return s
+	}
+	for i, key := range strings.Split(env, ",") {
+		s.inherited[key] = os.NewFile(uintptr(firstInheritedFd+i), key)
+	}
+	if fd, err := strconv.Atoi(os.Getenv(envReadyPipe)); err == nil {
+		s.ready = os.NewFile(uintptr(fd), envReadyPipe)
+	}
+	// the children of this process get only its own sockets
+	_ = os.Unsetenv(envInheritedSockets)
+	_ = os.Unsetenv(envReadyPipe)
+	return s
+}
+
+// take returns the inherited socket of the key if there's one.
+func (s *sockets) take(key string) *os.File {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	f, ok := s.inherited[key]
+	if !ok {
+		return nil
+	}
+	delete(s.inherited, key)
+	return f
+}
+
+// add saves a copy of the socket's descriptor for handing it off.
+func (s *sockets) add(key string, conn interface{ File() (*os.File, error) }) error {
+	f, err := conn.File()
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	s.keys = append(s.keys, key)
+	s.files = append(s.files, f)
+	s.mux.Unlock()
+	return nil
+}
+
+// listen creates a TCP listener or takes the one inherited from the previous process.
+func listen(address string) (net.Listener, error) {
+	key := "tcp " + address
+	var (
+		ln  net.Listener
+		err error
+	)
+	if f := listeningSockets.take(key); f != nil {
+		logger.Infof("Inherited listener %s\n", address)
+		ln, err = net.FileListener(f)
+		_ = f.Close()
+	} else {
+		ln, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tcpLn, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a TCP listener", address)
+	}
+	if err := listeningSockets.add(key, tcpLn); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listenPacket creates a UDP socket or takes the one inherited from the previous process.
+func listenPacket(address string) (net.PacketConn, error) {
+	key := "udp " + address
+	var (
+		pc  net.PacketConn
+		err error
+	)
+	if f := listeningSockets.take(key); f != nil {
+		logger.Infof("Inherited UDP socket %s\n", address)
+		pc, err = net.FilePacketConn(f)
+		_ = f.Close()
+	} else {
+		pc, err = net.ListenPacket("udp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn, ok := pc.(*net.UDPConn)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a UDP socket", address)
+	}
+	if err := listeningSockets.add(key, udpConn); err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// closeUnused closes the inherited sockets which aren't in the config anymore.
+func (s *sockets) closeUnused() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for key, f := range s.inherited {
+		logger.Warnf("Inherited socket %s isn't used\n", key)
+		_ = f.Close()
+	}
+	s.inherited = make(map[string]*os.File)
+}
+
+// notifyReady tells the previous process that this one serves,
+// it does nothing if the process isn't started by a handoff.
+func (s *sockets) notifyReady() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.ready == nil {
+		return
+	}
+	if _, err := io.WriteString(s.ready, readyMessage); err != nil {
+		logger.Warn("Unable to report readiness to the previous process", "err", err)
+	}
+	_ = s.ready.Close()
+	s.ready = nil
+}
+
+// newProcess is a process started by handoff.
+type newProcess struct {
+	*os.Process
+	ready *os.File
+}
+
+// handoff starts a new process of the binary with the listening sockets.
+// The new process opens the databases, so they must be released before.
+func (s *sockets) handoff() (*newProcess, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.files) == 0 {
+		return nil, errors.New("there are no sockets to hand off")
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(append([]*os.File(nil), s.files...), w)
+	cmd.Env = append(os.Environ(),
+		envInheritedSockets+"="+strings.Join(s.keys, ","),
+		envReadyPipe+"="+strconv.Itoa(firstInheritedFd+len(s.files)),
+	)
+	// Start makes the descriptors blocking, it's the same socket in this process,
+	// whose deadlines and Close wouldn't interrupt Accept then
+	defer s.setNonblock()
+	if err := cmd.Start(); err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	return &newProcess{Process: cmd.Process, ready: r}, nil
+}
+
+func (s *sockets) setNonblock() {
+	for i, f := range s.files {
+		rc, err := f.SyscallConn()
+		if err == nil {
+			var nonblockErr error
+			err = rc.Control(func(fd uintptr) {
+				nonblockErr = syscall.SetNonblock(int(fd), true)
+			})
+			if err == nil {
+				err = nonblockErr
+			}
+		}
+		if err != nil {
+			logger.Warn("Unable to make socket "+s.keys[i]+" non-blocking", "err", err)
+		}
+	}
+}
+
+// waitReady waits for the new process to report it's ready. If the process
+// exits before or doesn't report in time, it's killed and an error is returned.
+func (p *newProcess) waitReady(timeout time.Duration) error {
+	defer p.ready.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		// the pipe is closed without the message if the process exits
+		line, err := bufio.NewReader(p.ready).ReadString('\n')
+		if err == nil && line != readyMessage {
+			err = fmt.Errorf("unexpected message %q", line)
+		}
+		result <- err
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+		if errors.Is(err, io.EOF) {
+			err = errors.New("the new process has exited before getting ready")
+		}
+	case <-time.After(timeout):
+		err = fmt.Errorf("the new process hasn't got ready in %s", timeout)
+	}
+	if err != nil {
+		_ = p.Kill()
+		go func() {
+			_, _ = p.Wait()
+		}()
+	}
+	return err
+}
+
+// handOff passes the listening sockets and the databases to a new process of the binary.
+// The HTTP listeners are paused and the requests in flight are completed before
+// the databases are released, the new connections wait in the sockets' queues.
+// If the new process fails, the databases are reopened and this process goes on serving.
+func handOff(gate *handoffGate, databases []database, options *bolt.Options, drainTimeout time.Duration) error {
+	gate.pause()
+	if err := gate.drain(drainTimeout); err != nil {
+		logger.Warn("Requests haven't been completed before the handoff", "err", err)
+	}
+	closeDatabases(databases)
+
+	process, err := listeningSockets.handoff()
+	if err == nil {
+		logger.Infof("The sockets are handed off to process %d\n", process.Pid)
+		err = process.waitReady(handoffTimeout)
+	}
+	if err != nil {
+		reopenDatabases(databases, options)
+		gate.resume()
+		return err
+	}
+	gate.finish()
+	return nil
+}
+
+// handoffGate pauses the HTTP listeners and the requests while the databases are passed
+// to a new process. The requests using the databases are counted for draining,
+// upgraded connections don't use them and aren't paused.
+type handoffGate struct {
+	mux       sync.Mutex
+	open      chan struct{} // closed while serving
+	done      chan struct{} // closed when the new process serves
+	listeners []*gatedListener
+	inFlight  atomic.Int64
+}
+
+func newHandoffGate() *handoffGate {
+	open := make(chan struct{})
+	close(open)
+	return &handoffGate{open: open, done: make(chan struct{})}
+}
+
+// listener pauses accepting of ln with the gate, ln must be a TCP listener.
+func (g *handoffGate) listener(ln net.Listener) net.Listener {
+	tcpLn, ok := ln.(*net.TCPListener)
+	if !ok {
+		return ln
+	}
+	l := &gatedListener{TCPListener: tcpLn, gate: g, closed: make(chan struct{})}
+	g.mux.Lock()
+	g.listeners = append(g.listeners, l)
+	g.mux.Unlock()
+	return l
+}
+
+// handler holds the requests while the gate is paused. If the new process serves,
+// the requests get 503 and the client retries on a new connection.
+func (g *handoffGate) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if backend.IsUpgradeRequest(req) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		if !g.enter() {
+			rw.Header().Set("Connection", "close")
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer g.inFlight.Add(-1)
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// enter counts the request in flight when the gate is open, false is returned
+// if the new process serves. The request is counted before the check, so draining can't miss it.
+func (g *handoffGate) enter() bool {
+	for {
+		g.inFlight.Add(1)
+		open := g.opened()
+		select {
+		case <-open:
+			return true
+		default:
+		}
+		g.inFlight.Add(-1)
+
+		select {
+		case <-open:
+		case <-g.done:
+			return false
+		}
+	}
+}
+
+func (g *handoffGate) opened() chan struct{} {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return g.open
+}
+
+// pause stops accepting connections and taking requests,
+// the listeners waiting in Accept are interrupted by a deadline.
+func (g *handoffGate) pause() {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.open = make(chan struct{})
+	for _, l := range g.listeners {
+		_ = l.SetDeadline(time.Now())
+	}
+}
+
+// resume accepts connections and takes the held requests again.
+func (g *handoffGate) resume() {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	for _, l := range g.listeners {
+		_ = l.SetDeadline(time.Time{})
+	}
+	close(g.open)
+}
+
+// finish rejects the held requests, the listeners stay paused until they are closed.
+func (g *handoffGate) finish() {
+	close(g.done)
+}
+
+// drain waits for the requests in flight until timeout.
+func (g *handoffGate) drain(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(drainPollPeriod)
+	defer ticker.Stop()
+	for g.inFlight.Load() > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d requests are in flight after %s", g.inFlight.Load(), timeout)
+		}
+		<-ticker.C
+	}
+	return nil
+}
+
+// gatedListener doesn't accept connections while its gate is paused.
+type gatedListener struct {
+	*net.TCPListener
+	gate      *handoffGate
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *gatedListener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case <-l.gate.opened():
+		case <-l.closed:
+			return nil, net.ErrClosed
+		}
+		conn, err := l.TCPListener.Accept()
+		// the gate has been paused while waiting
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		return conn, err
+	}
+}
+
+func (l *gatedListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.TCPListener.Close()
+}
+
+// database is a bolt database of the process. Only one process can open it,
+// so it's passed to the new process on handoff and reopened if the handoff fails.
+type database struct {
+	name string
+	boltDatabase
+}
+
+type boltDatabase interface {
+	io.Closer
+	Reopen(options *bolt.Options) error
+}
+
+func closeDatabases(databases []database) {
+	for _, d := range databases {
+		if err := d.Close(); err != nil {
+			logger.Warn("Unable to close "+d.name+" bolt database", "err", err)
+			continue
+		}
+		logger.Info(d.name + " bolt database is closed")
+	}
+}
+
+// reopenDatabases opens the databases closed for a new process again,
+// the process can't serve without them.
+func reopenDatabases(databases []database, options *bolt.Options) {
+	for _, d := range databases {
+		if err := d.Reopen(options); err != nil {
+			logger.Fatal("Unable to reopen "+d.name+" bolt database", "err", err)
+		}
+		logger.Info(d.name + " bolt database is reopened")
+	}
+}
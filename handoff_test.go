@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	handoffAddress = "127.0.0.1:0"
+
+	// envHandoffTest tells the new process of the test binary how to behave
+	envHandoffTest = "BDUTS_TEST_HANDOFF"
+	handoffServe   = "serve"
+	handoffFail    = "fail"
+)
+
+// TestSocketsHandoff hands a listener off to a new process of the test binary,
+// the child takes it by the key from the environment, reports it's ready and answers on it.
+func TestSocketsHandoff(t *testing.T) {
+	logger = log.New(os.Stderr)
+
+	if len(listeningSockets.inherited) > 0 {
+		if os.Getenv(envHandoffTest) == handoffServe {
+			serveHandoffChild(t)
+		}
+		return
+	}
+	t.Setenv(envHandoffTest, handoffServe)
+
+	ln, err := listen(handoffAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	process, err := listeningSockets.handoff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		state, err := process.Wait()
+		if err != nil {
+			t.Error(err)
+		} else if !state.Success() {
+			t.Errorf("the new process has failed: %s", state)
+		}
+	}()
+	if err := process.waitReady(handoffTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// this process doesn't accept, so the connection is taken by the new one
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "tcp " + handoffAddress + "\n"; line != want {
+		t.Errorf("expected %q from the new process, got %q", want, line)
+	}
+}
+
+// TestHandoffNotReady checks that a new process exiting before it's ready is detected.
+func TestHandoffNotReady(t *testing.T) {
+	logger = log.New(os.Stderr)
+
+	if len(listeningSockets.inherited) > 0 {
+		return
+	}
+	t.Setenv(envHandoffTest, handoffFail)
+
+	ln, err := listen(handoffAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	process, err := listeningSockets.handoff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.waitReady(handoffTimeout); err == nil {
+		t.Fatal("expected an error for the process which isn't ready")
+	}
+
+	// this process goes on serving, so its listener must be interrupted by deadlines
+	_ = ln.(*net.TCPListener).SetDeadline(time.Now().Add(50 * time.Millisecond))
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected the deadline to be exceeded, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the listener is left blocking after the handoff")
+	}
+}
+
+// serveHandoffChild answers the first connection of the inherited listener
+// with its key, the result of the new process is its exit status.
+func serveHandoffChild(t *testing.T) {
+	if os.Getenv(envInheritedSockets) != "" || os.Getenv(envReadyPipe) != "" {
+		t.Fatal("the environment of the sockets isn't cleared")
+	}
+	f := listeningSockets.take("tcp " + handoffAddress)
+	if f == nil {
+		t.Fatal("the listener isn't inherited")
+	}
+	ln, err := net.FileListener(f)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	listeningSockets.notifyReady()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("tcp " + handoffAddress + "\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandoffGate(t *testing.T) {
+	gate := newHandoffGate()
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	server := &http.Server{Handler: gate.handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		_, _ = io.WriteString(rw, "ok")
+	}))}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.Serve(gate.listener(ln))
+	}()
+	defer server.Close()
+	url := "http://" + ln.Addr().String()
+
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		slow <- err
+	}()
+	<-started
+
+	// the request in flight is waited for
+	gate.pause()
+	if err := gate.drain(50 * time.Millisecond); err == nil {
+		t.Fatal("the request in flight isn't waited for")
+	}
+	close(release)
+	if err := gate.drain(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+
+	// the new connection waits in the queue until the gate is resumed
+	queued := make(chan error, 1)
+	go func() {
+		resp, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		queued <- err
+	}()
+	select {
+	case err := <-queued:
+		t.Fatalf("the request is served while the gate is paused: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	gate.resume()
+	select {
+	case err := <-queued:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued request isn't served after resuming")
+	}
+}
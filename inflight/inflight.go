@@ -0,0 +1,72 @@
+// Package inflight tracks the work which the HTTP servers don't wait for on shutdown:
+// hijacked and layer-4 connections, responses being saved in background.
+package inflight
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Group is a set of work in progress. Once Wait is called, no new work is taken,
+// so adding never races with waiting.
+type Group struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closing bool
+	conns   map[io.Closer]struct{}
+}
+
+// Add registers new work and returns false if the group is being waited for.
+// c is closed if the work isn't done in time, it may be nil.
+func (g *Group) Add(c io.Closer) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closing {
+		return false
+	}
+	g.wg.Add(1)
+	if c != nil {
+		if g.conns == nil {
+			g.conns = make(map[io.Closer]struct{})
+		}
+		g.conns[c] = struct{}{}
+	}
+	return true
+}
+
+// Done finishes the work registered by Add with the same c.
+func (g *Group) Done(c io.Closer) {
+	if c != nil {
+		g.mu.Lock()
+		delete(g.conns, c)
+		g.mu.Unlock()
+	}
+	g.wg.Done()
+}
+
+// Wait stops taking new work and waits for the current one until ctx is done,
+// then the connections left are closed.
+func (g *Group) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	g.closing = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		for c := range g.conns {
+			_ = c.Close()
+		}
+		g.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,61 @@
+package inflight
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type closer struct {
+	closed chan struct{}
+}
+
+func (c *closer) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestGroupWait(t *testing.T) {
+	var g Group
+	if !g.Add(nil) {
+		t.Fatal("the work isn't taken before Wait")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		g.Done(nil)
+	}()
+
+	if err := g.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if g.Add(nil) {
+		t.Fatal("the work is taken after Wait")
+	}
+}
+
+func TestGroupClosesOnTimeout(t *testing.T) {
+	var g Group
+	done := &closer{closed: make(chan struct{})}
+	left := &closer{closed: make(chan struct{})}
+	g.Add(done)
+	g.Add(left)
+	g.Done(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+
+	select {
+	case <-left.closed:
+	default:
+		t.Error("the connection left isn't closed")
+	}
+	select {
+	case <-done.closed:
+		t.Error("the finished connection is closed again")
+	default:
+	}
+}
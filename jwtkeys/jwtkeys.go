@@ -0,0 +1,341 @@
+// Package jwtkeys provides the keys verifying JSON Web Tokens issued by another service:
+// a key from a file or the keys of a JSON Web Key Set fetched by URL.
+package jwtkeys
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pelageech/BDUTS/config"
+)
+
+const (
+	defaultRefreshPeriod = 5 * time.Minute
+	retryPeriod          = 10 * time.Second
+	fetchTimeout         = 10 * time.Second
+
+	// maxKeySetSize limits the response of the key set URL
+	maxKeySetSize = 1 << 20
+)
+
+var logger = log.NewWithOptions(os.Stderr, log.Options{
+	ReportTimestamp: true,
+	ReportCaller:    true,
+})
+
+func LoggerConfig(prefix string) {
+	logger.SetPrefix(prefix)
+}
+
+// Keys verify the signatures of the tokens with the allowed algorithms.
+type Keys struct {
+	algorithms []string
+
+	// static is the key from the file
+	static interface{}
+
+	url           string
+	client        *http.Client
+	refreshPeriod time.Duration
+
+	mux sync.RWMutex
+	set map[string]key
+}
+
+// key is a key of the set, alg is empty if the set doesn't restrict it.
+type key struct {
+	alg string
+	key interface{}
+}
+
+// New creates Keys from config.RateLimitJWTConfig. The key file is read at once,
+// the key set is fetched by Refresh.
+func New(c *config.RateLimitJWTConfig) (*Keys, error) {
+	if len(c.Algorithms) == 0 {
+		return nil, errors.New("no algorithms of the tokens are allowed")
+	}
+	hmac := false
+	for _, alg := range c.Algorithms {
+		switch jwt.GetSigningMethod(alg).(type) {
+		case *jwt.SigningMethodHMAC:
+			hmac = true
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA, *jwt.SigningMethodEd25519:
+		default:
+			return nil, fmt.Errorf("unknown algorithm %q", alg)
+		}
+	}
+
+	k := &Keys{algorithms: c.Algorithms}
+	switch {
+	case c.KeyFile != "" && c.JWKSURL != "":
+		return nil, errors.New("either a key file or a key set URL must be set, not both")
+	case c.KeyFile != "":
+		b, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if hmac {
+			k.static = bytes.TrimRight(b, "\r\n")
+		} else if k.static, err = parsePublicKey(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", c.KeyFile, err)
+		}
+		for _, alg := range c.Algorithms {
+			if !fits(jwt.GetSigningMethod(alg), k.static) {
+				return nil, fmt.Errorf("the key of %s doesn't fit %s", c.KeyFile, alg)
+			}
+		}
+	case c.JWKSURL != "":
+		if hmac {
+			return nil, errors.New("HMAC algorithms need a key file, a key set has only public keys")
+		}
+		k.url = c.JWKSURL
+		k.client = &http.Client{Timeout: fetchTimeout}
+		k.refreshPeriod = time.Duration(c.RefreshPeriod) * time.Millisecond
+		if k.refreshPeriod <= 0 {
+			k.refreshPeriod = defaultRefreshPeriod
+		}
+	default:
+		return nil, errors.New("a key file or a key set URL must be set")
+	}
+	return k, nil
+}
+
+// Algorithms returns the allowed algorithms, they are passed to jwt.WithValidMethods.
+func (k *Keys) Algorithms() []string {
+	return k.algorithms
+}
+
+// Keyfunc returns the key of the token, it's passed to jwt.Parse.
+func (k *Keys) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if k.static != nil {
+		return k.static, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	k.mux.RLock()
+	found, ok := k.set[kid]
+	// a token without kid is verified by the only key of the set
+	if !ok && kid == "" && len(k.set) == 1 {
+		for _, only := range k.set {
+			found, ok = only, true
+		}
+	}
+	k.mux.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if found.alg != "" && found.alg != token.Method.Alg() {
+		return nil, fmt.Errorf("key %q is meant for %s", kid, found.alg)
+	}
+	if !fits(token.Method, found.key) {
+		return nil, fmt.Errorf("key %q doesn't fit %s", kid, token.Method.Alg())
+	}
+	return found.key, nil
+}
+
+// Refresh fetches the key set every refresh period until ctx is done,
+// a failed fetch is retried sooner. It returns at once for a key file.
+func (k *Keys) Refresh(ctx context.Context) {
+	if k.url == "" {
+		return
+	}
+	for {
+		period := k.refreshPeriod
+		if err := k.fetch(ctx); errors.Is(err, context.Canceled) {
+			return
+		} else if err != nil {
+			logger.Warnf("Fetching %s: %v", k.url, err)
+			period = retryPeriod
+		}
+
+		select {
+		case <-time.After(period):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// jwk is a key of JSON Web Key Set, only the signing keys
+// of RSA, EC and OKP (Ed25519) types are used.
+type jwk struct {
+	Kty string
+	Kid string
+	Alg string
+	Use string
+
+	// RSA
+	N string
+	E string
+
+	// EC and OKP
+	Crv string
+	X   string
+	Y   string
+}
+
+func (k *Keys) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, http.NoBody)
+	if err != nil {
+		return err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("key set URL returned %s", resp.Status)
+	}
+
+	var keySet struct {
+		Keys []jwk
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxKeySetSize)).Decode(&keySet); err != nil {
+		return err
+	}
+
+	set := make(map[string]key, len(keySet.Keys))
+	for _, j := range keySet.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		public, err := j.publicKey()
+		if err != nil {
+			logger.Warnf("Key %q of %s is skipped: %v", j.Kid, k.url, err)
+			continue
+		}
+		set[j.Kid] = key{alg: j.Alg, key: public}
+	}
+	if len(set) == 0 {
+		return errors.New("no signing keys in the key set")
+	}
+
+	k.mux.Lock()
+	k.set = set
+	k.mux.Unlock()
+	return nil
+}
+
+func (j *jwk) publicKey() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unknown curve %q", j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the point isn't on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unknown curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("wrong size of Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// parsePublicKey parses a PEM public key or the key of a PEM certificate.
+func parsePublicKey(b []byte) (interface{}, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM public key")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// fits checks if the key may verify the tokens of the method.
+func fits(method jwt.SigningMethod, k interface{}) bool {
+	switch m := method.(type) {
+	case *jwt.SigningMethodHMAC:
+		_, ok := k.([]byte)
+		return ok
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := k.(*rsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodECDSA:
+		public, ok := k.(*ecdsa.PublicKey)
+		return ok && public.Curve.Params().BitSize == m.CurveBits
+	case *jwt.SigningMethodEd25519:
+		_, ok := k.(ed25519.PublicKey)
+		return ok
+	}
+	return false
+}
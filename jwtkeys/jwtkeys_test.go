@@ -0,0 +1,229 @@
+package jwtkeys
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pelageech/BDUTS/config"
+)
+
+func writeFile(t *testing.T, b []byte) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(file, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func writePublicKey(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid, sub string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"sub": sub})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// subject returns the subject of the token verified by keys, it's empty if the token isn't valid.
+func subject(keys *Keys, token string) string {
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, keys.Keyfunc, jwt.WithValidMethods(keys.Algorithms())); err != nil {
+		return ""
+	}
+	sub, _ := claims.GetSubject()
+	return sub
+}
+
+func TestNewRejects(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecFile := writePublicKey(t, &ecKey.PublicKey)
+	secretFile := writeFile(t, []byte("secret\n"))
+
+	tests := []struct {
+		name string
+		c    config.RateLimitJWTConfig
+	}{
+		{"no algorithms", config.RateLimitJWTConfig{KeyFile: secretFile}},
+		{"unknown algorithm", config.RateLimitJWTConfig{KeyFile: secretFile, Algorithms: []string{"HS999"}}},
+		{"none", config.RateLimitJWTConfig{KeyFile: secretFile, Algorithms: []string{"none"}}},
+		{"no key", config.RateLimitJWTConfig{Algorithms: []string{"HS256"}}},
+		{"both keys", config.RateLimitJWTConfig{KeyFile: secretFile, JWKSURL: "http://127.0.0.1:1", Algorithms: []string{"RS256"}}},
+		{"HMAC key set", config.RateLimitJWTConfig{JWKSURL: "http://127.0.0.1:1", Algorithms: []string{"HS256"}}},
+		{"missing file", config.RateLimitJWTConfig{KeyFile: filepath.Join(t.TempDir(), "missing"), Algorithms: []string{"HS256"}}},
+		{"secret for RSA", config.RateLimitJWTConfig{KeyFile: secretFile, Algorithms: []string{"RS256"}}},
+		{"secret with RSA", config.RateLimitJWTConfig{KeyFile: secretFile, Algorithms: []string{"HS256", "RS256"}}},
+		{"EC key for RSA", config.RateLimitJWTConfig{KeyFile: ecFile, Algorithms: []string{"RS256"}}},
+		{"EC key of another curve", config.RateLimitJWTConfig{KeyFile: ecFile, Algorithms: []string{"ES384"}}},
+	}
+	for _, tt := range tests {
+		if _, err := New(&tt.c); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := New(&config.RateLimitJWTConfig{KeyFile: writePublicKey(t, &ecKey.PublicKey), Algorithms: []string{"ES256"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sub := subject(keys, sign(t, jwt.SigningMethodES256, ecKey, "", "alice")); sub != "alice" {
+		t.Errorf("expected alice, got %q", sub)
+	}
+	if sub := subject(keys, sign(t, jwt.SigningMethodES256, other, "", "bob")); sub != "" {
+		t.Errorf("the token of another key is verified: %q", sub)
+	}
+
+	secret := []byte("secret")
+	keys, err = New(&config.RateLimitJWTConfig{KeyFile: writeFile(t, append(secret, '\n')), Algorithms: []string{"HS256"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub := subject(keys, sign(t, jwt.SigningMethodHS256, secret, "", "carol")); sub != "carol" {
+		t.Errorf("expected carol, got %q", sub)
+	}
+	if sub := subject(keys, sign(t, jwt.SigningMethodHS512, secret, "", "dave")); sub != "" {
+		t.Errorf("the token of not allowed algorithm is verified: %q", sub)
+	}
+}
+
+func rsaJWK(kid, alg string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"alg": alg,
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func TestKeySet(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rotate atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		set := []map[string]string{
+			rsaJWK("rsa", "RS256", &rsaKey.PublicKey),
+			{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "x": base64.RawURLEncoding.EncodeToString(edPublic)},
+			{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+		}
+		if rotate.Load() {
+			set = append(set, rsaJWK("rotated", "", &rotated.PublicKey))
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{"keys": set})
+	}))
+	defer server.Close()
+
+	keys, err := New(&config.RateLimitJWTConfig{
+		JWKSURL:       server.URL,
+		RefreshPeriod: 10,
+		Algorithms:    []string{"RS256", "RS384", "EdDSA"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	refreshed := make(chan struct{})
+	go func() {
+		keys.Refresh(ctx)
+		close(refreshed)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for subject(keys, sign(t, jwt.SigningMethodRS256, rsaKey, "rsa", "alice")) == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("the key set isn't fetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"ed25519", sign(t, jwt.SigningMethodEdDSA, edKey, "ed", "bob"), "bob"},
+		{"unknown kid", sign(t, jwt.SigningMethodRS256, rsaKey, "other", "carol"), ""},
+		{"no kid", sign(t, jwt.SigningMethodRS256, rsaKey, "", "carol"), ""},
+		{"another key", sign(t, jwt.SigningMethodRS256, rotated, "rsa", "dave"), ""},
+		{"algorithm of the key", sign(t, jwt.SigningMethodRS384, rsaKey, "rsa", "erin"), ""},
+		{"type of the key", sign(t, jwt.SigningMethodRS256, rsaKey, "ed", "frank"), ""},
+	}
+	for _, tt := range tests {
+		if sub := subject(keys, tt.token); sub != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, sub)
+		}
+	}
+
+	// a new key is verified after the set is fetched again
+	rotate.Store(true)
+	token := sign(t, jwt.SigningMethodRS384, rotated, "rotated", "grace")
+	for subject(keys, token) != "grace" {
+		if time.Now().After(deadline) {
+			t.Fatal("the key set isn't refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Refresh doesn't return after ctx is done")
+	}
+}
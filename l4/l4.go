@@ -0,0 +1,99 @@
+// Package l4 implements layer-4 load balancing of raw TCP connections
+// and UDP datagrams between the servers of a backend.ServerPool.
+package l4
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+)
+
+const (
+	directionReceived = "received"
+	directionSent     = "sent"
+)
+
+// errNoFreeServer is returned when each backend has no free connection or session slot.
+var errNoFreeServer = errors.New("all the servers are busy")
+
+var logger = log.NewWithOptions(os.Stderr, log.Options{
+	ReportTimestamp: true,
+	ReportCaller:    true,
+})
+
+func LoggerConfig(prefix string) {
+	logger.SetPrefix(prefix)
+}
+
+// balancer is a named pool of servers with its own health checks,
+// it's shared by the TCP and UDP proxies.
+type balancer struct {
+	name              string
+	pool              *backend.ServerPool
+	healthCheckPeriod time.Duration
+	healthCheckFunc   func(*backend.Backend)
+}
+
+// newBalancer creates a pool of the servers. healthCheckPeriodMs is taken from the proxy config,
+// if it isn't set, healthCheckPeriod is used.
+func newBalancer(
+	name string,
+	servers []config.ServerConfig,
+	healthCheckPeriodMs int64,
+	healthCheckPeriod time.Duration,
+	healthCheckFunc func(*backend.Backend),
+) *balancer {
+	if healthCheckPeriodMs > 0 {
+		healthCheckPeriod = time.Duration(healthCheckPeriodMs) * time.Millisecond
+	}
+
+	pool := backend.NewServerPool()
+	pool.ConfigureServerPool(servers)
+
+	return &balancer{
+		name:              name,
+		pool:              pool,
+		healthCheckPeriod: healthCheckPeriod,
+		healthCheckFunc:   healthCheckFunc,
+	}
+}
+
+// Pool returns the server pool of the proxy.
+func (b *balancer) Pool() *backend.ServerPool {
+	return b.pool
+}
+
+// HealthChecker periodically checks all the backends of the proxy until ctx is done.
+func (b *balancer) HealthChecker(ctx context.Context) {
+	ticker := time.NewTicker(b.healthCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		b.CheckHealth()
+	}
+}
+
+// CheckHealth checks all the backends of the proxy concurrently and waits for the results.
+func (b *balancer) CheckHealth() {
+	wg := sync.WaitGroup{}
+	servers := b.pool.Servers()
+	wg.Add(len(servers))
+	for _, server := range servers {
+		server := server
+		go func() {
+			b.healthCheckFunc(server)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,156 @@
+package l4
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientHelloTimeout is the maximal time of waiting for ClientHello of a new connection.
+const clientHelloTimeout = 5 * time.Second
+
+var errHelloRead = errors.New("ClientHello is read")
+
+// SNIListener peeks at the server name of TLS ClientHello without decrypting.
+// The connections with the names of routes are passed through to their TCP proxies,
+// others are returned by Accept with ClientHello replayed, so the TLS-terminating
+// listener can wrap SNIListener.
+type SNIListener struct {
+	net.Listener
+	routes map[string]*TCPProxy
+
+	conns     chan net.Conn
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+// NewSNIListener starts accepting connections from ln. routes maps server names
+// to the proxies, a name may be a wildcard like *.example.com matching one label.
+func NewSNIListener(ln net.Listener, routes map[string]*TCPProxy) *SNIListener {
+	r := make(map[string]*TCPProxy, len(routes))
+	for name, proxy := range routes {
+		r[strings.ToLower(name)] = proxy
+	}
+
+	l := &SNIListener{
+		Listener: ln,
+		routes:   r,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+// Accept returns the next connection which isn't passed through.
+func (l *SNIListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *SNIListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.closeOnce.Do(func() {
+				l.err = err
+				close(l.done)
+			})
+			return
+		}
+		go l.route(conn)
+	}
+}
+
+// route reads ClientHello and sends the connection to its destination.
+func (l *SNIListener) route(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, hello := readServerName(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+
+	replayed := &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)}
+	if proxy := l.match(serverName); proxy != nil {
+		logger.Infof("[%s] %s is passed through by SNI %q\n", proxy.name, conn.RemoteAddr(), serverName)
+		proxy.ServeConn(replayed)
+		return
+	}
+
+	select {
+	case l.conns <- replayed:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+// match finds the proxy of the server name, exact names are preferred to wildcards.
+func (l *SNIListener) match(serverName string) *TCPProxy {
+	if serverName == "" {
+		return nil
+	}
+	serverName = strings.ToLower(serverName)
+	if proxy, ok := l.routes[serverName]; ok {
+		return proxy
+	}
+	if i := strings.IndexByte(serverName, '.'); i > 0 {
+		return l.routes["*"+serverName[i:]]
+	}
+	return nil
+}
+
+// readServerName parses ClientHello by crypto/tls, the handshake is stopped
+// right after it. The read bytes are returned for replaying.
+// The server name is empty if the connection doesn't start with ClientHello.
+func readServerName(conn net.Conn) (string, []byte) {
+	buf := &bytes.Buffer{}
+	var serverName string
+	_ = tls.Server(&helloConn{Conn: conn, r: io.TeeReader(conn, buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	return serverName, buf.Bytes()
+}
+
+// helloConn is a read-only connection for parsing ClientHello,
+// the alerts of the stopped handshake aren't sent to the client.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *helloConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *helloConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// replayConn is net.Conn reading the already read bytes first.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite lets the TCP proxy half-close the client connection.
+func (c *replayConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,66 @@
+package l4
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+)
+
+func TestSNIListener(t *testing.T) {
+	passthrough := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("passthrough"))
+	}))
+	defer passthrough.Close()
+
+	proxy := NewTCPProxy("sni", config.TCPProxyConfig{
+		Servers: []config.ServerConfig{{
+			URL:                   "tcp://" + passthrough.Listener.Addr().String(),
+			HealthCheckTcpTimeout: 100,
+			MaximalRequests:       10,
+		}},
+	}, time.Second, func(b *backend.Backend) {
+		b.SetAlive(b.CheckIfAlive())
+	})
+	proxy.CheckHealth()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sni := NewSNIListener(ln, map[string]*TCPProxy{"*.Passthrough.test": proxy})
+	defer sni.Close()
+
+	// the connections which aren't passed through are terminated here
+	terminating := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("terminated"))
+	}))
+	terminating.Listener = sni
+	terminating.StartTLS()
+	defer terminating.Close()
+
+	for serverName, expected := range map[string]string{
+		"api.passthrough.test": "passthrough",
+		"passthrough.test":     "terminated",
+		"other.test":           "terminated",
+	} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		}}
+		resp, err := client.Get("https://" + ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: %v", serverName, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expected {
+			t.Errorf("%s: expected %q, got %q", serverName, expected, body)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package l4
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/inflight"
+	"github.com/pelageech/BDUTS/metrics"
+	"github.com/pelageech/BDUTS/realip"
+)
+
+const (
+	protocolTCP = "tcp"
+
+	defaultIdleTimeout = 5 * time.Minute
+	copyBufferSize     = 32 << 10
+)
+
+// TCPProxy balances raw TCP connections between the servers of its pool.
+// MaximalRequests of a backend limits how many connections it has at the same time.
+type TCPProxy struct {
+	*balancer
+	idleTimeout time.Duration
+
+	// conns are the connections being proxied, they are waited for on shutdown
+	conns inflight.Group
+}
+
+// NewTCPProxy creates a new TCPProxy with the servers from config.
+// name is used in logs and metrics.
+func NewTCPProxy(
+	name string,
+	c config.TCPProxyConfig,
+	healthCheckPeriod time.Duration,
+	healthCheckFunc func(*backend.Backend),
+) *TCPProxy {
+	idleTimeout := time.Duration(c.IdleTimeout) * time.Millisecond
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	return &TCPProxy{
+		balancer:    newBalancer(name, c.Servers, c.HealthCheckPeriod, healthCheckPeriod, healthCheckFunc),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Serve accepts connections on ln and proxies each of them in a new goroutine.
+func (p *TCPProxy) Serve(ln net.Listener) error {
+	logger.Infof("TCP proxy %s started at %s\n", p.name, ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go p.ServeConn(conn)
+	}
+}
+
+// ServeConn proxies the client connection to one of the backends
+// and closes it when the transfer is finished.
+func (p *TCPProxy) ServeConn(client net.Conn) {
+	defer client.Close()
+	if !p.conns.Add(client) {
+		return
+	}
+	defer p.conns.Done(client)
+
+	ctx := context.Background()
+	if addr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+		ctx = realip.NewContext(ctx, addr.IP)
+	}
+
+	server, conn, err := p.connect(ctx)
+	if err != nil {
+		logger.Warnf("[%s] %s: %v", p.name, client.RemoteAddr(), err)
+		return
+	}
+	defer server.Free()
+	defer conn.Close()
+
+	metrics.UpdateL4Connections(p.name, protocolTCP, 1)
+	defer metrics.UpdateL4Connections(p.name, protocolTCP, -1)
+
+	logger.Infof("[%s] %s is connected to %s\n", p.name, client.RemoteAddr(), server.URL().Host)
+	received, sent := p.splice(client, conn)
+	logger.Infof("[%s] %s is disconnected, received %d bytes, sent %d bytes\n",
+		p.name, client.RemoteAddr(), received, sent)
+}
+
+// Shutdown waits for the connections being proxied until ctx is done,
+// then the connections left are closed. The connections served after the call are closed at once.
+// The listeners must be closed by the caller.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	return p.conns.Wait(ctx)
+}
+
+// connect chooses an alive backend with a free connection slot and dials it.
+// It gives up after trying each backend once. The slot must be freed by the caller.
+func (p *TCPProxy) connect(ctx context.Context) (*backend.Backend, net.Conn, error) {
+	for i := 0; i < len(p.pool.Servers()); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		server, err := p.pool.GetNextPeer()
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok := server.AssignRequest(); !ok {
+			continue
+		}
+
+		conn, err := server.Dial(ctx)
+		if err != nil {
+			logger.Errorf("[%s] %s", server.URL(), err)
+			server.SetAlive(false)
+			server.Free()
+			continue
+		}
+		return server, conn, nil
+	}
+	return nil, nil, errNoFreeServer
+}
+
+// splice copies bytes in both directions until both of them are finished
+// or there's no traffic during the idle timeout.
+func (p *TCPProxy) splice(client, server net.Conn) (received, sent int64) {
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		received = p.copy(server, client, directionReceived, &lastActivity)
+	}()
+	go func() {
+		defer wg.Done()
+		sent = p.copy(client, server, directionSent, &lastActivity)
+	}()
+	wg.Wait()
+	return received, sent
+}
+
+// copy transfers bytes from src to dst. On EOF the write side of dst is closed,
+// so the other direction may go on. On errors both the connections are closed.
+func (p *TCPProxy) copy(dst, src net.Conn, direction string, lastActivity *atomic.Int64) int64 {
+	buf := make([]byte, copyBufferSize)
+	var written int64
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActivity.Store(time.Now().UnixNano())
+			_ = dst.SetWriteDeadline(time.Now().Add(p.idleTimeout))
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				closeBoth(dst, src)
+				return written
+			}
+			written += int64(n)
+			metrics.UpdateL4Bytes(p.name, protocolTCP, direction, n)
+		}
+
+		var netErr net.Error
+		switch {
+		case err == nil:
+			continue
+		case errors.As(err, &netErr) && netErr.Timeout() &&
+			time.Since(time.Unix(0, lastActivity.Load())) < p.idleTimeout:
+			// the other direction is active
+			continue
+		case errors.Is(err, io.EOF):
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+				return written
+			}
+		}
+		closeBoth(dst, src)
+		return written
+	}
+}
+
+func closeBoth(a, b net.Conn) {
+	_ = a.Close()
+	_ = b.Close()
+}
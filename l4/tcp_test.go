@@ -0,0 +1,76 @@
+package l4
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+)
+
+func TestTCPProxyClosesWhenBusy(t *testing.T) {
+	// the backend holds the connections open and sends nothing
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	proxy := NewTCPProxy("test", config.TCPProxyConfig{
+		Servers: []config.ServerConfig{{
+			URL:                   "tcp://" + backendLn.Addr().String(),
+			HealthCheckTcpTimeout: 100,
+			MaximalRequests:       1,
+		}},
+	}, time.Second, func(b *backend.Backend) {
+		b.SetAlive(b.CheckIfAlive())
+	})
+	proxy.CheckHealth()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		_ = proxy.Serve(ln)
+	}()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	deadline := time.Now().Add(time.Second)
+	for proxy.pool.Servers()[0].ActiveRequests() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first connection isn't proxied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the only slot is taken, the connection of another client is closed
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
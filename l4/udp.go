@@ -0,0 +1,241 @@
+package l4
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/metrics"
+)
+
+const (
+	protocolUDP = "udp"
+
+	defaultSessionTimeout = 30 * time.Second
+	minExpiryCheckPeriod  = 100 * time.Millisecond
+	maxDatagramSize       = 64 << 10
+)
+
+// UDPProxy balances UDP datagrams between the servers of its pool.
+// The datagrams of a client address are sent to the same server while
+// the session is active. MaximalRequests of a backend limits its sessions.
+type UDPProxy struct {
+	*balancer
+	sessionTimeout time.Duration
+
+	mux      sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// udpSession binds a client address to a backend. Each session has its own
+// socket, so the replies of the backend are matched to the client.
+type udpSession struct {
+	client       net.Addr
+	server       *backend.Backend
+	conn         net.Conn
+	lastActivity atomic.Int64
+	closeOnce    sync.Once
+}
+
+// NewUDPProxy creates a new UDPProxy with the servers from config.
+// name is used in logs and metrics.
+func NewUDPProxy(
+	name string,
+	c config.UDPProxyConfig,
+	healthCheckPeriod time.Duration,
+	healthCheckFunc func(*backend.Backend),
+) *UDPProxy {
+	sessionTimeout := time.Duration(c.SessionTimeout) * time.Millisecond
+	if sessionTimeout <= 0 {
+		sessionTimeout = defaultSessionTimeout
+	}
+
+	return &UDPProxy{
+		balancer:       newBalancer(name, c.Servers, c.HealthCheckPeriod, healthCheckPeriod, healthCheckFunc),
+		sessionTimeout: sessionTimeout,
+		sessions:       make(map[string]*udpSession),
+	}
+}
+
+// Serve reads datagrams from pc and forwards them to the backends.
+// The sessions are closed when Serve returns.
+func (p *UDPProxy) Serve(pc net.PacketConn) error {
+	logger.Infof("UDP proxy %s started at %s\n", p.name, pc.LocalAddr())
+
+	done := make(chan struct{})
+	defer close(done)
+	go p.expireSessions(done)
+	defer p.closeSessions()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		s, err := p.session(pc, addr)
+		if err != nil {
+			logger.Warnf("[%s] %s: datagram is dropped: %v", p.name, addr, err)
+			metrics.UpdateL4DroppedDatagrams(p.name)
+			continue
+		}
+
+		s.lastActivity.Store(time.Now().UnixNano())
+		if _, err := s.conn.Write(buf[:n]); err != nil {
+			logger.Errorf("[%s] %s", s.server.URL(), err)
+			metrics.UpdateL4DroppedDatagrams(p.name)
+			p.closeSession(s)
+			continue
+		}
+		metrics.UpdateL4Bytes(p.name, protocolUDP, directionReceived, n)
+	}
+}
+
+// session returns the active session of the client or creates a new one.
+// A session with a dead backend is replaced.
+func (p *UDPProxy) session(pc net.PacketConn, addr net.Addr) (*udpSession, error) {
+	key := addr.String()
+
+	p.mux.Lock()
+	s, ok := p.sessions[key]
+	p.mux.Unlock()
+	if ok {
+		if s.server.Alive() {
+			return s, nil
+		}
+		p.closeSession(s)
+	}
+
+	s, err := p.connect(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mux.Lock()
+	p.sessions[key] = s
+	p.mux.Unlock()
+
+	metrics.UpdateL4Connections(p.name, protocolUDP, 1)
+	logger.Infof("[%s] %s is bound to %s\n", p.name, addr, s.server.URL().Host)
+	go p.reply(pc, s)
+	return s, nil
+}
+
+// connect chooses an alive backend with a free session slot and opens a socket to it.
+// It runs on the reader of the datagrams, so it doesn't wait for a slot
+// and gives up after trying each backend once.
+func (p *UDPProxy) connect(addr net.Addr) (*udpSession, error) {
+	for i := 0; i < len(p.pool.Servers()); i++ {
+		server, err := p.pool.GetNextPeer()
+		if err != nil {
+			return nil, err
+		}
+		if ok := server.TryAssignRequest(); !ok {
+			continue
+		}
+
+		conn, err := net.Dial("udp", server.URL().Host)
+		if err != nil {
+			logger.Errorf("[%s] %s", server.URL(), err)
+			server.SetAlive(false)
+			server.Free()
+			continue
+		}
+
+		s := &udpSession{client: addr, server: server, conn: conn}
+		s.lastActivity.Store(time.Now().UnixNano())
+		return s, nil
+	}
+	return nil, errNoFreeServer
+}
+
+// reply sends the datagrams of the backend back to the client until the session is closed.
+func (p *UDPProxy) reply(pc net.PacketConn, s *udpSession) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			p.closeSession(s)
+			return
+		}
+
+		s.lastActivity.Store(time.Now().UnixNano())
+		if _, err := pc.WriteTo(buf[:n], s.client); err != nil {
+			logger.Errorf("[%s] %s: %v", p.name, s.client, err)
+			continue
+		}
+		metrics.UpdateL4Bytes(p.name, protocolUDP, directionSent, n)
+	}
+}
+
+// expireSessions periodically closes the sessions without datagrams
+// for the session timeout until done is closed.
+func (p *UDPProxy) expireSessions(done <-chan struct{}) {
+	period := p.sessionTimeout / 2
+	if period < minExpiryCheckPeriod {
+		period = minExpiryCheckPeriod
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		var expired []*udpSession
+		p.mux.Lock()
+		for _, s := range p.sessions {
+			if time.Since(time.Unix(0, s.lastActivity.Load())) >= p.sessionTimeout {
+				expired = append(expired, s)
+			}
+		}
+		p.mux.Unlock()
+
+		for _, s := range expired {
+			logger.Infof("[%s] session of %s has expired\n", p.name, s.client)
+			p.closeSession(s)
+		}
+	}
+}
+
+// closeSession removes the session, closes its socket and frees the slot of the backend.
+func (p *UDPProxy) closeSession(s *udpSession) {
+	s.closeOnce.Do(func() {
+		p.mux.Lock()
+		if p.sessions[s.client.String()] == s {
+			delete(p.sessions, s.client.String())
+		}
+		p.mux.Unlock()
+
+		_ = s.conn.Close()
+		s.server.Free()
+		metrics.UpdateL4Connections(p.name, protocolUDP, -1)
+	})
+}
+
+func (p *UDPProxy) closeSessions() {
+	p.mux.Lock()
+	sessions := make([]*udpSession, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.mux.Unlock()
+
+	for _, s := range sessions {
+		p.closeSession(s)
+	}
+}
+
+// Sessions returns the number of active client sessions.
+func (p *UDPProxy) Sessions() int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return len(p.sessions)
+}
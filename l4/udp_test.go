@@ -0,0 +1,175 @@
+package l4
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMain(m *testing.M) {
+	metrics.Init(0, 0)
+	os.Exit(m.Run())
+}
+
+// echoServer answers each datagram with its id followed by the datagram.
+func echoServer(t *testing.T, id string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(append([]byte(id), buf[:n]...), addr)
+		}
+	}()
+	return "udp://" + pc.LocalAddr().String()
+}
+
+func startUDPProxy(t *testing.T, c config.UDPProxyConfig) (*UDPProxy, string) {
+	t.Helper()
+	p := NewUDPProxy("test", c, time.Second, func(b *backend.Backend) {
+		b.SetAlive(b.CheckIfAlive())
+	})
+	p.CheckHealth()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		_ = p.Serve(pc)
+	}()
+	return p, pc.LocalAddr().String()
+}
+
+func exchange(t *testing.T, conn net.Conn, msg string) string {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxDatagramSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestUDPProxySessionAffinity(t *testing.T) {
+	servers := []config.ServerConfig{
+		{URL: echoServer(t, "a:"), HealthCheckTcpTimeout: 100, MaximalRequests: 10},
+		{URL: echoServer(t, "b:"), HealthCheckTcpTimeout: 100, MaximalRequests: 10},
+	}
+	p, addr := startUDPProxy(t, config.UDPProxyConfig{Servers: servers})
+
+	first, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	r1 := exchange(t, first, "1")
+	for _, msg := range []string{"2", "3", "4"} {
+		if r := exchange(t, first, msg); r[:2] != r1[:2] || r[2:] != msg {
+			t.Errorf("expected %q from the same server, got %q", r1[:2]+msg, r)
+		}
+	}
+
+	if r2 := exchange(t, second, "1"); r2[:2] == r1[:2] {
+		t.Errorf("expected the second client to be sent to another server, both got %q", r2[:2])
+	}
+	if n := p.Sessions(); n != 2 {
+		t.Errorf("expected 2 sessions, got %d", n)
+	}
+}
+
+func TestUDPProxySessionExpiry(t *testing.T) {
+	servers := []config.ServerConfig{
+		{URL: echoServer(t, "a:"), HealthCheckTcpTimeout: 100, MaximalRequests: 1},
+	}
+	p, addr := startUDPProxy(t, config.UDPProxyConfig{Servers: servers, SessionTimeout: 200})
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	exchange(t, conn, "1")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Sessions() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session hasn't expired")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the slot of the only server is free again, a new session can be opened
+	other, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if r := exchange(t, other, "2"); r != "a:2" {
+		t.Errorf("expected %q, got %q", "a:2", r)
+	}
+}
+
+func TestUDPProxyDropsWhenBusy(t *testing.T) {
+	servers := []config.ServerConfig{
+		{URL: echoServer(t, "a:"), HealthCheckTcpTimeout: 100, MaximalRequests: 1},
+	}
+	_, addr := startUDPProxy(t, config.UDPProxyConfig{Servers: servers})
+	dropped := metrics.GlobalMetrics.L4DroppedDatagrams.WithLabelValues("test")
+	before := testutil.ToFloat64(dropped)
+
+	first, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	exchange(t, first, "1")
+
+	// the only slot is taken, the datagram of another client is dropped
+	second, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if _, err := second.Write([]byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	_ = second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := second.Read(make([]byte, maxDatagramSize)); err == nil {
+		t.Fatal("expected the datagram to be dropped")
+	}
+	if n := testutil.ToFloat64(dropped) - before; n != 1 {
+		t.Errorf("expected 1 dropped datagram, got %v", n)
+	}
+
+	// the reader isn't blocked by the busy server
+	if r := exchange(t, first, "3"); r != "a:3" {
+		t.Errorf("expected %q, got %q", "a:3", r)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"net/http"
 
-	"github.com/pelageech/BDUTS/backend"
 	"github.com/pelageech/BDUTS/config"
 )
 
@@ -55,7 +54,7 @@ func (lb *LoadBalancer) AddServerHandler(rw http.ResponseWriter, req *http.Reque
 			HealthCheckTcpTimeout: int64(add.HealthCheckTcpTimeout),
 			MaximalRequests:       int32(add.MaximalRequests),
 		}
-		b := backend.NewBackendConfig(server)
+		b := lb.pool.NewBackend(server)
 		if b == nil {
 			http.Error(rw, "Bad URL", http.StatusBadRequest)
 			return
@@ -85,6 +84,7 @@ func (lb *LoadBalancer) RemoveServerHandler(rw http.ResponseWriter, req *http.Re
 			http.Error(rw, "Server doesn't exist", http.StatusNotFound)
 			return
 		}
+		lb.registrations.remove(rem.Url)
 		_, _ = rw.Write([]byte("Success!"))
 	case http.MethodGet:
 		http.ServeFile(rw, req, "views/remove.html")
@@ -97,7 +97,10 @@ type getResponseJSON struct {
 	URL                   string
 	HealthCheckTcpTimeout int64
 	MaximalRequests       int
+	ActiveRequests        int
+	LimitAlgorithm        string
 	Alive                 bool
+	Draining              bool
 }
 
 // GetServersHandler takes all the information about the backends from the server pool and puts
@@ -115,7 +118,10 @@ func (lb *LoadBalancer) GetServersHandler(rw http.ResponseWriter, req *http.Requ
 			URL:                   (*v).URL().String(),
 			HealthCheckTcpTimeout: (*v).HealthCheckTcpTimeout().Milliseconds(),
 			MaximalRequests:       (*v).MaximalRequests(),
+			ActiveRequests:        v.ActiveRequests(),
+			LimitAlgorithm:        v.LimitAlgorithm(),
 			Alive:                 v.Alive(),
+			Draining:              v.Draining(),
 		})
 	}
 
@@ -0,0 +1,128 @@
+package lb
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The headers with the verified client certificate which are sent to the backends by default.
+const (
+	defaultClientCertSubjectHeader = "X-Client-Cert-Subject"
+	defaultClientCertSANsHeader    = "X-Client-Cert-SANs"
+)
+
+// clientCertHeaders are the names of the headers with the client certificate.
+type clientCertHeaders struct {
+	subject string
+	sans    string
+}
+
+func newClientCertHeaders() *clientCertHeaders {
+	return &clientCertHeaders{
+		subject: defaultClientCertSubjectHeader,
+		sans:    defaultClientCertSANsHeader,
+	}
+}
+
+// SetClientCertHeaders sets the names of the headers with the subject and SANs
+// of the client certificate. The default name is used for an empty one.
+func (lb *LoadBalancer) SetClientCertHeaders(subject, sans string) {
+	h := newClientCertHeaders()
+	if subject != "" {
+		h.subject = subject
+	}
+	if sans != "" {
+		h.sans = sans
+	}
+	lb.clientCertHeaders = h
+}
+
+// setClientCertHeaders forwards the subject and SANs of the verified client certificate.
+// The headers sent by the client are always removed, so they can't be forged.
+func (lb *LoadBalancer) setClientCertHeaders(req *http.Request) {
+	req.Header.Del(lb.clientCertHeaders.subject)
+	req.Header.Del(lb.clientCertHeaders.sans)
+
+	cert := verifiedClientCert(req)
+	if cert == nil {
+		return
+	}
+	req.Header.Set(lb.clientCertHeaders.subject, cert.Subject.String())
+	if sans := subjectAltNames(cert); len(sans) > 0 {
+		req.Header.Set(lb.clientCertHeaders.sans, strings.Join(sans, ", "))
+	}
+}
+
+// verifiedClientCert returns the client certificate verified against the CA of the listener.
+func verifiedClientCert(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// issuedBy returns true if one of the verified chains of the client certificate
+// contains one of cas, so a route may trust only a part of the CAs of the listener.
+func issuedBy(req *http.Request, cas []*x509.Certificate) bool {
+	for _, chain := range req.TLS.VerifiedChains {
+		for _, cert := range chain {
+			for _, ca := range cas {
+				if cert.Equal(ca) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// loadClientCAs reads the certificates of a PEM bundle.
+func loadClientCAs(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var cas []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		cas = append(cas, cert)
+	}
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("no certificates are found in %s", file)
+	}
+	return cas, nil
+}
+
+// subjectAltNames lists SANs in the form of OpenSSL, e.g. "DNS:example.com".
+func subjectAltNames(cert *x509.Certificate) []string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	return sans
+}
@@ -0,0 +1,169 @@
+package lb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/config"
+)
+
+// newTestCert creates a self-signed certificate, the verification isn't needed
+// because the chains are put to the requests as verified ones.
+func newTestCert(t *testing.T, name string, dnsNames ...string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeCertFile(t *testing.T, cert *x509.Certificate) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func withClientChain(req *http.Request, chain ...*x509.Certificate) *http.Request {
+	req.TLS = &tls.ConnectionState{PeerCertificates: chain[:1], VerifiedChains: [][]*x509.Certificate{chain}}
+	return req
+}
+
+func TestSetClientCertHeaders(t *testing.T) {
+	lb := NewLoadBalancer(nil, nil, nil)
+	leaf := newTestCert(t, "client", "api.partner.test")
+
+	tests := []struct {
+		name    string
+		tls     *tls.ConnectionState
+		subject string
+		sans    string
+	}{
+		{"plain HTTP", nil, "", ""},
+		{"no certificate", &tls.ConnectionState{}, "", ""},
+		{"not verified", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}, "", ""},
+		{"verified", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf},
+			VerifiedChains:   [][]*x509.Certificate{{leaf}},
+		}, "CN=client", "DNS:api.partner.test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.TLS = tt.tls
+			// the client can't forge the headers
+			req.Header.Set(defaultClientCertSubjectHeader, "CN=admin")
+			req.Header.Set(defaultClientCertSANsHeader, "DNS:admin.test")
+
+			lb.setClientCertHeaders(req)
+			if got := req.Header.Get(defaultClientCertSubjectHeader); got != tt.subject {
+				t.Errorf("expected subject %q, got %q", tt.subject, got)
+			}
+			if got := req.Header.Get(defaultClientCertSANsHeader); got != tt.sans {
+				t.Errorf("expected SANs %q, got %q", tt.sans, got)
+			}
+		})
+	}
+}
+
+func TestSetClientCertHeadersNames(t *testing.T) {
+	lb := NewLoadBalancer(nil, nil, nil)
+	lb.SetClientCertHeaders("X-Subject", "")
+	leaf := newTestCert(t, "client")
+
+	req := withClientChain(httptest.NewRequest(http.MethodGet, "/", nil), leaf)
+	req.Header.Set(defaultClientCertSubjectHeader, "CN=admin")
+	lb.setClientCertHeaders(req)
+
+	if got := req.Header.Get("X-Subject"); got != "CN=client" {
+		t.Errorf("expected the subject in X-Subject, got %q", got)
+	}
+	if got := req.Header.Get(defaultClientCertSubjectHeader); got != "CN=admin" {
+		t.Errorf("the header which isn't used for certificates is changed: %q", got)
+	}
+}
+
+func TestRouteClientCA(t *testing.T) {
+	partner := newTestCert(t, "partner CA")
+	other := newTestCert(t, "other CA")
+	leaf := newTestCert(t, "client")
+
+	lb := NewLoadBalancer(nil, nil, nil)
+	err := lb.SetRoutes([]config.RouteConfig{
+		{Path: "/partner", ClientCAFile: writeCertFile(t, partner)},
+		{Path: "/any", RequireClientCert: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		chain   []*x509.Certificate
+		allowed bool
+	}{
+		{"partner CA", "/partner", []*x509.Certificate{leaf, partner}, true},
+		{"other CA", "/partner", []*x509.Certificate{leaf, other}, false},
+		{"no certificate", "/partner", nil, false},
+		{"any CA", "/any", []*x509.Certificate{leaf, other}, true},
+		{"no certificate on any CA", "/any", nil, false},
+		{"not required", "/", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.chain != nil {
+				req = withClientChain(req, tt.chain...)
+			}
+			route := lb.routes.match(req.URL.Path)
+			if got := lb.routes.clientCertAllowed(route, req); got != tt.allowed {
+				t.Errorf("expected allowed %v, got %v", tt.allowed, got)
+			}
+		})
+	}
+}
+
+func TestRouteClientCAFileWithoutCertificates(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(file, []byte("no certificates"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	lb := NewLoadBalancer(nil, nil, nil)
+	if err := lb.SetRoutes([]config.RouteConfig{{Path: "/", ClientCAFile: file}}); err == nil {
+		t.Fatal("expected an error for a bundle without certificates")
+	}
+}
@@ -0,0 +1,78 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pelageech/BDUTS/realip"
+)
+
+// viaPseudonym is the name of the balancer in the Via header.
+const viaPseudonym = "bduts"
+
+// SetClientIPResolver sets the resolver of client addresses,
+// the addresses of trusted proxies are skipped in X-Forwarded-For.
+func (lb *LoadBalancer) SetClientIPResolver(r *realip.Resolver) {
+	lb.clientIPResolver = r
+}
+
+// setForwardedHeaders adds X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host,
+// Forwarded (RFC 7239) and Via to the request and saves the client address in the context.
+// If the peer isn't a trusted proxy, the forwarding headers it sent are replaced
+// so the backends can't be deceived.
+func (lb *LoadBalancer) setForwardedHeaders(req *http.Request) {
+	peer := realip.PeerIP(req)
+	client := lb.clientIPResolver.ClientIP(req)
+	*req = *req.WithContext(realip.NewContext(req.Context(), client))
+
+	h := req.Header
+	if !lb.clientIPResolver.IsTrusted(peer) {
+		h.Del("X-Forwarded-For")
+		h.Del("X-Forwarded-Proto")
+		h.Del("X-Forwarded-Host")
+		h.Del("Forwarded")
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if peer != nil {
+		if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+			h.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+peer.String())
+		} else {
+			h.Set("X-Forwarded-For", peer.String())
+		}
+	}
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", req.Host)
+	}
+
+	h.Add("Forwarded", forwardedElement(peer, req.Host, proto))
+	h.Add("Via", via(req.ProtoMajor, req.ProtoMinor))
+}
+
+// forwardedElement builds an element of Forwarded header.
+func forwardedElement(peer net.IP, host, proto string) string {
+	node := "unknown"
+	if peer != nil {
+		node = peer.String()
+		if peer.To4() == nil {
+			node = `"[` + node + `]"`
+		}
+	}
+	return fmt.Sprintf("for=%s;host=%q;proto=%s", node, host, proto)
+}
+
+func via(major, minor int) string {
+	if major >= 2 {
+		return fmt.Sprintf("%d %s", major, viaPseudonym)
+	}
+	return fmt.Sprintf("%d.%d %s", major, minor, viaPseudonym)
+}
@@ -0,0 +1,275 @@
+package lb
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/metrics"
+)
+
+const (
+	defaultHedgingBudget = 10 // percent of the requests
+	maxHedgingTokens     = 10 // hedged requests which may be sent in a burst
+	percent              = 100
+
+	latencySamples      = 1000
+	minLatencySamples   = 100
+	quantileUpdateEvery = 100
+)
+
+// hedger decides when a request of a route is sent to another backend.
+type hedger struct {
+	delay   time.Duration
+	latency *latencyTracker
+	budget  *hedgingBudget
+}
+
+func newHedger(c *config.HedgingConfig) *hedger {
+	h := &hedger{
+		delay:  time.Duration(c.Delay) * time.Millisecond,
+		budget: newHedgingBudget(c.Budget),
+	}
+	if c.Quantile > 0 {
+		h.latency = newLatencyTracker(c.Quantile)
+	}
+	return h
+}
+
+// hedgeDelay returns how long the first backend is waited for.
+// Without a delay the requests aren't hedged.
+func (h *hedger) hedgeDelay() (time.Duration, bool) {
+	if h.latency != nil {
+		if d, ok := h.latency.value(); ok {
+			return d, true
+		}
+	}
+	return h.delay, h.delay > 0
+}
+
+func (h *hedger) observe(d time.Duration) {
+	if h.latency != nil {
+		h.latency.observe(d)
+	}
+}
+
+// isHedgeable checks if a copy of the request may be sent: the method is safe
+// and there's no body which can be read only once. The body is checked by
+// ContentLength as Body is never nil for HTTP/2 and is wrapped by the handler.
+func isHedgeable(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.ContentLength == 0
+}
+
+// hedgingBudget limits the share of the hedged requests: each request
+// adds a part of a token, each hedged request takes a whole one.
+type hedgingBudget struct {
+	mux    sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func newHedgingBudget(budget float64) *hedgingBudget {
+	if budget <= 0 {
+		budget = defaultHedgingBudget
+	}
+	return &hedgingBudget{ratio: budget / percent}
+}
+
+func (b *hedgingBudget) deposit() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > maxHedgingTokens {
+		b.tokens = maxHedgingTokens
+	}
+}
+
+func (b *hedgingBudget) withdraw() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *hedgingBudget) refund() {
+	b.mux.Lock()
+	b.tokens++
+	b.mux.Unlock()
+}
+
+// latencyTracker keeps the last response times and their quantile,
+// which is recomputed after every quantileUpdateEvery samples.
+type latencyTracker struct {
+	mux      sync.Mutex
+	q        float64
+	samples  []time.Duration
+	next     int
+	added    int
+	quantile time.Duration
+}
+
+func newLatencyTracker(q float64) *latencyTracker {
+	return &latencyTracker{q: q, samples: make([]time.Duration, 0, latencySamples)}
+}
+
+func (t *latencyTracker) observe(d time.Duration) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if len(t.samples) < latencySamples {
+		t.samples = append(t.samples, d)
+	} else {
+		t.samples[t.next] = d
+		t.next = (t.next + 1) % latencySamples
+	}
+
+	t.added++
+	if t.added%quantileUpdateEvery != 0 || len(t.samples) < minLatencySamples {
+		return
+	}
+	sorted := make([]time.Duration, len(t.samples))
+	copy(sorted, t.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(t.q * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	t.quantile = sorted[i]
+}
+
+// value returns the quantile if there have been enough samples.
+func (t *latencyTracker) value() (time.Duration, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.quantile, t.quantile > 0
+}
+
+// attempt is a request sent to a backend while hedging.
+type attempt struct {
+	i      int
+	server *backend.Backend
+	resp   *http.Response
+	err    error
+}
+
+// sendHedged sends req to server and, if it hasn't responded within the delay,
+// a copy to another backend. The first successful response is used, the other
+// request is canceled. The returned cancel func must be called and the backend
+// must be freed after the response is read. On error the backends are already freed.
+func (lb *LoadBalancer) sendHedged(
+	req *http.Request,
+	route *config.RouteConfig,
+	server *backend.Backend,
+	h *hedger,
+) (*backend.Backend, *http.Response, context.CancelFunc, error) {
+	h.budget.deposit()
+
+	// the body is empty, but the transport would probe the wrapped one from both copies
+	noBody := *req
+	noBody.Body = http.NoBody
+	req = &noBody
+
+	results := make(chan attempt, 2)
+	var cancels []context.CancelFunc
+	send := func(server *backend.Backend) {
+		ctx, cancel := context.WithCancel(req.Context())
+		tryReq, cancelTry := withTryTimeout(req.WithContext(ctx), route, server)
+		cancels = append(cancels, func() {
+			cancelTry()
+			cancel()
+		})
+
+		i := len(cancels) - 1
+		go func() {
+			start := time.Now()
+			resp, err := server.SendRequestToBackend(tryReq)
+			if err == nil {
+				h.observe(time.Since(start))
+			}
+			results <- attempt{i: i, server: server, resp: resp, err: err}
+		}()
+	}
+
+	send(server)
+	pending := 1
+
+	var timeout <-chan time.Time
+	if delay, ok := h.hedgeDelay(); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var failed *attempt
+	for pending > 0 {
+		select {
+		case <-timeout:
+			timeout = nil
+			if !h.budget.withdraw() {
+				continue
+			}
+			other := lb.hedgePeer(server)
+			if other == nil {
+				h.budget.refund()
+				continue
+			}
+			logger.Infof("[%s] hasn't responded in time, the request is sent to %s\n", server.URL(), other.URL())
+			send(other)
+			pending++
+
+		case a := <-results:
+			pending--
+			if a.err != nil {
+				cancels[a.i]()
+				a.server.Free()
+				if failed == nil {
+					failed = &a
+				} else {
+					logger.Warnf("[%s] hedged request failed: %s\n", a.server.URL(), a.err)
+				}
+				continue
+			}
+
+			if len(cancels) > 1 {
+				metrics.UpdateHedgedRequests(a.i > 0)
+			}
+			for i, cancel := range cancels {
+				if i != a.i {
+					cancel()
+				}
+			}
+			// the response of the other request is dropped
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					r := <-results
+					if r.resp != nil {
+						_ = r.resp.Body.Close()
+					}
+					r.server.Free()
+				}
+			}(pending)
+			return a.server, a.resp, cancels[a.i], nil
+		}
+	}
+	return failed.server, nil, cancels[failed.i], failed.err
+}
+
+// hedgePeer chooses a backend other than exclude for the copy of the request.
+func (lb *LoadBalancer) hedgePeer(exclude *backend.Backend) *backend.Backend {
+	for i := 0; i < len(lb.pool.Servers()); i++ {
+		server, err := lb.pool.GetNextPeer()
+		if err != nil {
+			return nil
+		}
+		if server != exclude && server.AssignRequest() {
+			return server
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+)
+
+func TestHedgingBudget(t *testing.T) {
+	b := newHedgingBudget(25)
+
+	hedged := 0
+	for i := 0; i < 100; i++ {
+		b.deposit()
+		if b.withdraw() {
+			hedged++
+		}
+	}
+	if hedged != 25 {
+		t.Errorf("expected 25 hedged requests of 100, got %d", hedged)
+	}
+}
+
+func TestLatencyTracker(t *testing.T) {
+	tr := newLatencyTracker(0.95)
+	for i := 1; i < minLatencySamples; i++ {
+		tr.observe(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := tr.value(); ok {
+		t.Fatal("the quantile is returned before there are enough samples")
+	}
+
+	tr.observe(minLatencySamples * time.Millisecond)
+	d, ok := tr.value()
+	if !ok || d != 96*time.Millisecond {
+		t.Errorf("expected p95 96ms, got %s %t", d, ok)
+	}
+}
+
+func TestIsHedgeable(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *http.Request
+		want bool
+	}{
+		{"get", httptest.NewRequest(http.MethodGet, "/", nil), true},
+		{"head", httptest.NewRequest(http.MethodHead, "/", nil), true},
+		{"post", httptest.NewRequest(http.MethodPost, "/", nil), false},
+		{"get with body", httptest.NewRequest(http.MethodGet, "/", strings.NewReader("body")), false},
+		{"get with wrapped body", func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Body = &requestBody{ReadCloser: http.MaxBytesReader(nil, http.NoBody, 1)}
+			return req
+		}(), true},
+		{"get with unknown length", func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/", strings.NewReader("body"))
+			req.ContentLength = -1
+			return req
+		}(), false},
+	}
+	for _, tt := range tests {
+		if got := isHedgeable(tt.req); got != tt.want {
+			t.Errorf("%s: isHedgeable() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestHedgedRequest sends requests through LoadBalancerHandler to two backends,
+// the first request is answered slowly, so a hedged one is answered first.
+func TestHedgedRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		http2       bool
+		maxBodySize int64
+		body        string
+		want        string
+	}{
+		{name: "HTTP/2", http2: true, want: "fast"},
+		{name: "max body size", maxBodySize: 1 << 10, want: "fast"},
+		{name: "HTTP/2 with max body size", http2: true, maxBodySize: 1 << 10, want: "fast"},
+		{name: "with body", http2: true, body: "body", want: "slow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tries atomic.Int32
+			handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if tries.Add(1) == 1 {
+					select {
+					case <-req.Context().Done():
+						return
+					case <-time.After(300 * time.Millisecond):
+					}
+					_, _ = io.WriteString(rw, "slow")
+					return
+				}
+				_, _ = io.WriteString(rw, "fast")
+			})
+
+			// the responses are larger than the cacheable size, there's no cache
+			lb := NewLoadBalancer(NewLoadBalancerConfig(0, 0, 0, 0, 1), nil, nil)
+			err := lb.SetRoutes([]config.RouteConfig{{
+				Path:        "/",
+				MaxBodySize: tt.maxBodySize,
+				Hedging:     &config.HedgingConfig{Delay: 50, Budget: 100},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				server := httptest.NewServer(handler)
+				defer server.Close()
+				b := backend.NewBackend(mustParseURL(t, server.URL), time.Second, 1)
+				b.SetAlive(true)
+				lb.Pool().AddServer(b)
+			}
+
+			front := httptest.NewUnstartedServer(http.HandlerFunc(lb.LoadBalancerHandler))
+			front.EnableHTTP2 = tt.http2
+			front.StartTLS()
+			defer front.Close()
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req, err := http.NewRequest(http.MethodGet, front.URL, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := front.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if tt.http2 && resp.ProtoMajor != 2 {
+				t.Fatalf("expected HTTP/2, got %s", resp.Proto)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expected the %s response, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -15,17 +15,62 @@ import (
 
 // LoadBalancerHandler is the main handler for load balancer.
 func (lb *LoadBalancer) LoadBalancerHandler(rw http.ResponseWriter, req *http.Request) {
+	lb.setForwardedHeaders(req)
+	lb.setClientCertHeaders(req)
+
+	route := lb.routes.match(req.URL.Path)
+	if lb.shed(req, route) {
+		rw.Header().Set("Retry-After", retryAfterShed)
+		http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !lb.rateLimit(rw, req) {
+		return
+	}
+
+	if !lb.routes.clientCertAllowed(route, req) {
+		http.Error(rw, "Client certificate is required", http.StatusForbidden)
+		return
+	}
+
+	// upgraded connections live long and aren't cached, they're out of the request time metrics
+	if backend.IsUpgradeRequest(req) {
+		if err := lb.upgradeHandler(rw, req, route); err != nil {
+			logger.Error("Unsuccessful upgrade processing: ", "err", err)
+		}
+		return
+	}
+
+	defer lb.trackInFlight()()
+
+	req, cancel := withTimeout(req, route)
+	defer cancel()
+
+	if limit := route.MaxBodySize; limit > 0 {
+		if req.ContentLength > limit {
+			http.Error(rw, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = http.MaxBytesReader(rw, req.Body, limit)
+	}
+
+	// the body is streamed to the backend and counted on the way
+	body := &requestBody{ReadCloser: req.Body}
+	if req.Body != http.NoBody {
+		req.Body = body
+	}
+
 	if err := timer.MakeRequestTimeTracker(lb.loadBalancerHandler, timer.SaveTimeFullTrip, true)(rw, req); err != nil {
 		logger.Error("Unsuccessful request processing: ", "err", err)
 	}
-	metrics.UpdateRequestBodySize(req)
+	metrics.UpdateRequestBodySize(float64(body.Size()))
 }
 
 // loadBalancerHandler is the main Handle func.
 func (lb *LoadBalancer) loadBalancerHandler(rw http.ResponseWriter, req *http.Request) error {
 	if !isHTTPVersionSupported(req) {
-		http.Error(rw, "Expected HTTP/1.1", http.StatusHTTPVersionNotSupported)
-		return fmt.Errorf("expected HTTP/1.1")
+		http.Error(rw, "Expected HTTP/1.1 or HTTP/2", http.StatusHTTPVersionNotSupported)
+		return fmt.Errorf("expected HTTP/1.1 or HTTP/2, got %s", req.Proto)
 	}
 
 	requestHash := lb.cacheProps.RequestHashKey(req)
@@ -85,6 +130,8 @@ func (lb *LoadBalancer) getPageHandler(rw http.ResponseWriter, req *http.Request
 }
 
 func (lb *LoadBalancer) backendHandler(rw http.ResponseWriter, req *http.Request) error {
+	route := lb.routes.match(req.URL.Path)
+
 ChooseServer:
 	server, err := lb.pool.GetNextPeer()
 	if err != nil {
@@ -99,24 +146,65 @@ ChooseServer:
 	defer metrics.GlobalMetrics.RequestsNow.Dec()
 	defer metrics.GlobalMetrics.Requests.Inc()
 
-	var resp *http.Response
+	// the try timeout also limits streaming the response body
+	var (
+		resp      *http.Response
+		cancelTry context.CancelFunc
+	)
 	err = timer.MakeRequestTimeTracker(func(rw http.ResponseWriter, req *http.Request) error {
 		var err error
-		resp, err = server.SendRequestToBackend(req)
-		server.Free()
+		if h := lb.routes.hedger(route); h != nil && isHedgeable(req) {
+			server, resp, cancelTry, err = lb.sendHedged(req, route, server, h)
+			return err
+		}
+
+		var tryReq *http.Request
+		tryReq, cancelTry = withTryTimeout(req, route, server)
+		resp, err = server.SendRequestToBackend(tryReq)
+		if err != nil {
+			server.Free()
+		}
 		return err
 	}, timer.SaveTimeDataBackend, false)(rw, req)
 
+	var maxBytesErr *http.MaxBytesError
+	body, hasBody := req.Body.(*requestBody)
+	bodySent := hasBody && body.Size() > 0
+
+	if err != nil {
+		cancelTry()
+	}
+
 	// on cancellation
 	if errors.Is(err, context.Canceled) {
 		return fmt.Errorf("[%s]: %w", server.URL(), err)
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		// a slow backend isn't dead, the request is tried on another one if the total time is limited
+		logger.Warnf("[%s] timed out\n", server.URL())
+		if _, ok := req.Context().Deadline(); ok && req.Context().Err() == nil && !bodySent {
+			goto ChooseServer
+		}
+		http.Error(rw, "Gateway Timeout", http.StatusGatewayTimeout)
+		return fmt.Errorf("[%s]: %w", server.URL(), err)
+	} else if errors.As(err, &maxBytesErr) {
+		http.Error(rw, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return fmt.Errorf("[%s]: %w", server.URL(), err)
+	} else if err != nil && bodySent {
+		// the body has been partly sent and can't be sent to another backend
+		logger.Errorf("[%s] %s", server.URL(), err)
+		server.SetAlive(false)
+		http.Error(rw, "Bad Gateway", http.StatusBadGateway)
+		return fmt.Errorf("[%s]: %w", server.URL(), err)
 	} else if err != nil {
 		logger.Errorf("[%s] %s", server.URL(), err)
 		server.SetAlive(false) // СДЕЛАТЬ СЧЁТЧИК ИЛИ ПОЧИТАТЬ КАК У НДЖИНКС
 		goto ChooseServer
 	}
+	defer cancelTry()
 
 	logger.Infof("[%s] returned %s\n", server.URL(), resp.Status)
+	// the slot is released after the body is streamed and closed
+	defer server.Free()
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
@@ -124,14 +212,27 @@ ChooseServer:
 		}
 	}(resp.Body)
 
-	byteArray, err := backend.WriteBodyAndReturn(rw, resp)
+	resp.Header.Add("Via", via(resp.ProtoMajor, resp.ProtoMinor))
+	capture := lb.newCacheCapture(req, resp)
+	var tee io.Writer
+	if capture != nil {
+		tee = capture
+	}
+
+	var size int64
+	err = timer.MakeRequestTimeTracker(func(rw http.ResponseWriter, req *http.Request) error {
+		var err error
+		size, err = backend.WriteResponse(rw, resp, tee)
+		return err
+	}, timer.SaveTimeTransfer, false)(rw, req)
+	metrics.UpdateResponseBodySize(float64(size))
 	if err != nil {
 		return fmt.Errorf("[%s]: %w", server.URL(), err)
 	}
 
-	metrics.UpdateResponseBodySize(float64(len(byteArray)))
-
-	go lb.SaveToCache(req, resp, byteArray)
+	if capture != nil && !capture.overflow {
+		lb.SaveToCache(req, resp, capture.buf.Bytes())
+	}
 
 	return nil
 }
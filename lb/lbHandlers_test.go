@@ -0,0 +1,63 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+)
+
+func TestBackendSlotHeldWhileStreaming(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(rw, "first ")
+		rw.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(rw, "last")
+	}))
+	defer server.Close()
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+
+	lb := NewLoadBalancer(NewLoadBalancerConfig(0, 0, 0, 0, 0), nil, nil)
+	b := backend.NewBackend(mustParseURL(t, server.URL), time.Second, 1)
+	b.SetAlive(true)
+	lb.Pool().AddServer(b)
+
+	front := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_ = lb.backendHandler(rw, req)
+	}))
+	defer front.Close()
+
+	resp, err := http.Post(front.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, len("first "))
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.AssignRequest() {
+		b.Free()
+		t.Fatal("the slot is released before the body is streamed")
+	}
+
+	unblock()
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !b.AssignRequest() {
+		if time.Now().After(deadline) {
+			t.Fatal("the slot isn't released after the body is streamed")
+		}
+	}
+	b.Free()
+}
@@ -1,6 +1,7 @@
 package lb
 
 import (
+	"context"
 	"net/http"
 	"os"
 	"sync"
@@ -10,8 +11,12 @@ import (
 	"github.com/pelageech/BDUTS/backend"
 	"github.com/pelageech/BDUTS/cache"
 	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/inflight"
+	"github.com/pelageech/BDUTS/realip"
 )
 
+const defaultMaxCacheableSize = 10 << 20
+
 // LoadBalancerConfig is parse from `config.json` file.
 // It contains all the necessary information of the load balancer.
 type LoadBalancerConfig struct {
@@ -19,6 +24,7 @@ type LoadBalancerConfig struct {
 	healthCheckPeriod time.Duration
 	maxCacheSize      int64
 	observeFrequency  time.Duration
+	maxCacheableSize  int64
 }
 
 var logger = log.NewWithOptions(os.Stderr, log.Options{
@@ -35,12 +41,17 @@ func NewLoadBalancerConfig(
 	healthCheckPeriod time.Duration,
 	maxCacheSize int64,
 	observeFrequency time.Duration,
+	maxCacheableSize int64,
 ) *LoadBalancerConfig {
+	if maxCacheableSize <= 0 {
+		maxCacheableSize = defaultMaxCacheableSize
+	}
 	return &LoadBalancerConfig{
 		port:              port,
 		healthCheckPeriod: healthCheckPeriod,
 		maxCacheSize:      maxCacheSize,
 		observeFrequency:  observeFrequency,
+		maxCacheableSize:  maxCacheableSize,
 	}
 }
 
@@ -60,13 +71,30 @@ func (c *LoadBalancerConfig) ObserveFrequency() time.Duration {
 	return c.observeFrequency
 }
 
+// MaxCacheableSize is the maximal size of a response body which can be saved in cache.
+// Larger responses are only streamed to the client.
+func (c *LoadBalancerConfig) MaxCacheableSize() int64 {
+	return c.maxCacheableSize
+}
+
 // LoadBalancer is a struct that contains all the configuration
 // of the load balancer.
 type LoadBalancer struct {
-	config          *LoadBalancerConfig
-	pool            *backend.ServerPool
-	cacheProps      *cache.CachingProperties
-	healthCheckFunc func(*backend.Backend)
+	config            *LoadBalancerConfig
+	pool              *backend.ServerPool
+	cacheProps        *cache.CachingProperties
+	healthCheckFunc   func(*backend.Backend)
+	registrations     *registrations
+	routes            *routeTable
+	clientIPResolver  *realip.Resolver
+	clientCertHeaders *clientCertHeaders
+	shedder           *loadShedder
+	rateLimiter       *rateLimiter
+
+	// cacheWrites are the responses being saved in cache,
+	// upgraded are the hijacked connections the HTTP servers don't wait for.
+	cacheWrites inflight.Group
+	upgraded    inflight.Group
 }
 
 // NewLoadBalancer is the constructor of the load balancer.
@@ -76,10 +104,13 @@ func NewLoadBalancer(
 	healthChecker func(*backend.Backend),
 ) *LoadBalancer {
 	return &LoadBalancer{
-		config:          config,
-		pool:            backend.NewServerPool(),
-		cacheProps:      cachingProperties,
-		healthCheckFunc: healthChecker,
+		config:            config,
+		pool:              backend.NewServerPool(),
+		cacheProps:        cachingProperties,
+		healthCheckFunc:   healthChecker,
+		registrations:     newRegistrations(),
+		routes:            &routeTable{},
+		clientCertHeaders: newClientCertHeaders(),
 	}
 }
 
@@ -115,12 +146,17 @@ func (lb *LoadBalancer) HealthCheckFunc() func(*backend.Backend) {
 	return lb.healthCheckFunc
 }
 
-// HealthChecker periodically checks all the backends in balancer pool.
-func (lb *LoadBalancer) HealthChecker() {
+// HealthChecker periodically checks all the backends in balancer pool until ctx is done.
+func (lb *LoadBalancer) HealthChecker(ctx context.Context) {
 	ticker := time.NewTicker(lb.config.healthCheckPeriod)
+	defer ticker.Stop()
 	wg := sync.WaitGroup{}
 	for {
-		<-ticker.C
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		wg.Add(len(lb.pool.Servers()))
 		logger.Info("Health Check has been started!")
 
@@ -138,11 +174,11 @@ func (lb *LoadBalancer) HealthChecker() {
 
 // isHTTPVersionSupported checks if the HTTP version is supported.
 //
-// The balancer supports only HTTP 1.1 version because
-// the backends use a common HTTP protocol.
+// The balancer supports HTTP/1.1 and HTTP/2, the version
+// used for the backends doesn't depend on the client's one.
 func isHTTPVersionSupported(req *http.Request) bool {
 	if maj, min, ok := http.ParseHTTPVersion(req.Proto); ok {
-		if maj == 1 && min == 1 {
+		if maj == 1 && min == 1 || maj == 2 && min == 0 {
 			return true
 		}
 	}
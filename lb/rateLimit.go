@@ -0,0 +1,185 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/jwtkeys"
+	"github.com/pelageech/BDUTS/metrics"
+	"github.com/pelageech/BDUTS/ratelimit"
+	"github.com/pelageech/BDUTS/realip"
+)
+
+const (
+	rateLimitKeyIP     = "ip"
+	rateLimitKeyRoute  = "route"
+	rateLimitKeyJWT    = "jwt"
+	rateLimitKeyHeader = "header:"
+)
+
+type rateLimitRule struct {
+	path   string
+	key    string
+	header string
+	limit  ratelimit.Limit
+}
+
+type rateLimiter struct {
+	rules   []rateLimitRule
+	store   ratelimit.Store
+	jwtKeys *jwtkeys.Keys
+}
+
+// SetRateLimits sets the limits of requests, their buckets are kept in store.
+// jwtKeys verify the tokens of the limits by JWT subject, they may be nil if there are no such limits.
+func (lb *LoadBalancer) SetRateLimits(limits []config.RateLimitConfig, store ratelimit.Store, jwtKeys *jwtkeys.Keys) error {
+	if len(limits) == 0 {
+		lb.rateLimiter = nil
+		return nil
+	}
+
+	rules := make([]rateLimitRule, 0, len(limits))
+	for _, c := range limits {
+		if c.Rate <= 0 || c.Burst <= 0 {
+			return fmt.Errorf("rate limit %q of %q must have positive rate and burst", c.Key, c.Path)
+		}
+		rule := rateLimitRule{
+			path:  c.Path,
+			key:   c.Key,
+			limit: ratelimit.Limit{Rate: c.Rate, Burst: c.Burst},
+		}
+		switch {
+		case c.Key == rateLimitKeyIP, c.Key == rateLimitKeyRoute:
+		case c.Key == rateLimitKeyJWT:
+			if jwtKeys == nil {
+				return fmt.Errorf("rate limit %q of %q needs the keys of the tokens", c.Key, c.Path)
+			}
+		case strings.HasPrefix(c.Key, rateLimitKeyHeader) && len(c.Key) > len(rateLimitKeyHeader):
+			rule.header = strings.TrimPrefix(c.Key, rateLimitKeyHeader)
+		default:
+			return fmt.Errorf("unknown rate limit key %q", c.Key)
+		}
+		rules = append(rules, rule)
+	}
+	lb.rateLimiter = &rateLimiter{rules: rules, store: store, jwtKeys: jwtKeys}
+	return nil
+}
+
+// rateLimit takes a token from the bucket of each limit of the request and sets RateLimit-*
+// headers of the most exhausted one. If a bucket is empty, the request is rejected with 429
+// and the tokens taken from the other buckets are refunded.
+func (lb *LoadBalancer) rateLimit(rw http.ResponseWriter, req *http.Request) bool {
+	l := lb.rateLimiter
+	if l == nil {
+		return true
+	}
+
+	type taken struct {
+		key  string
+		rule *rateLimitRule
+	}
+	var (
+		tightest *ratelimit.Result
+		rejected *rateLimitRule
+		tokens   []taken
+	)
+	for i := range l.rules {
+		rule := &l.rules[i]
+		if !matchPath(req.URL.Path, rule.path) {
+			continue
+		}
+
+		key := strconv.Itoa(i) + " " + rule.value(req, l.jwtKeys)
+		r, err := l.store.Take(req.Context(), key, rule.limit)
+		if err != nil {
+			// the requests aren't limited while the store doesn't work
+			logger.Errorf("Failed to check rate limit %q: %s\n", rule.key, err)
+			continue
+		}
+		if !r.Allowed {
+			rejected = rule
+			tightest = &r
+			break
+		}
+		tokens = append(tokens, taken{key: key, rule: rule})
+		if tightest == nil || r.Remaining < tightest.Remaining {
+			tightest = &r
+		}
+	}
+	if tightest == nil {
+		return true
+	}
+
+	if rejected != nil {
+		for _, t := range tokens {
+			if err := l.store.Refund(req.Context(), t.key, t.rule.limit); err != nil {
+				logger.Errorf("Failed to refund rate limit %q: %s\n", t.rule.key, err)
+			}
+		}
+	}
+
+	h := rw.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(tightest.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(tightest.Reset)))
+	if rejected == nil {
+		return true
+	}
+
+	metrics.UpdateRateLimitedRequests(rejected.key)
+	h.Set("Retry-After", strconv.Itoa(ceilSeconds(tightest.RetryAfter)))
+	http.Error(rw, "Too Many Requests", http.StatusTooManyRequests)
+	return false
+}
+
+// value returns what the request is counted by.
+func (r *rateLimitRule) value(req *http.Request, jwtKeys *jwtkeys.Keys) string {
+	switch {
+	case r.key == rateLimitKeyRoute:
+		return r.path
+	case r.key == rateLimitKeyJWT:
+		if sub := jwtSubject(req, jwtKeys); sub != "" {
+			return "sub:" + sub
+		}
+	case r.header != "":
+		if v := req.Header.Get(r.header); v != "" {
+			return "header:" + v
+		}
+	}
+	return "ip:" + clientIP(req.Context())
+}
+
+// jwtSubject returns the subject of the bearer token verified by keys.
+// It's empty if the token isn't valid.
+func jwtSubject(req *http.Request, keys *jwtkeys.Keys) string {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, keys.Keyfunc, jwt.WithValidMethods(keys.Algorithms()))
+	if err != nil {
+		return ""
+	}
+	sub, _ := claims.GetSubject()
+	return sub
+}
+
+func clientIP(ctx context.Context) string {
+	if ip, ok := realip.FromContext(ctx); ok && ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// ceilSeconds rounds d up to seconds, the headers have no fractions.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
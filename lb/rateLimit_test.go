@@ -0,0 +1,135 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/jwtkeys"
+	"github.com/pelageech/BDUTS/ratelimit"
+)
+
+var testJWTKey = []byte("test signing key")
+
+// newTestJWTKeys verifies the tokens signed by testJWTKey with HS256.
+func newTestJWTKeys(t *testing.T) *jwtkeys.Keys {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "jwt.key")
+	if err := os.WriteFile(file, append(testJWTKey, '\n'), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jwtkeys.New(&config.RateLimitJWTConfig{KeyFile: file, Algorithms: []string{"HS256"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func rateLimited(t *testing.T, lb *LoadBalancer, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	lb.setForwardedHeaders(req)
+	rw := httptest.NewRecorder()
+	lb.rateLimit(rw, req)
+	return rw
+}
+
+func TestRateLimit(t *testing.T) {
+	lb := NewLoadBalancer(nil, nil, nil)
+	err := lb.SetRateLimits([]config.RateLimitConfig{{Key: "ip", Rate: 1, Burst: 1}}, ratelimit.NewMemoryStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := rateLimited(t, lb, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusOK || rw.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("expected an allowed request with no remaining ones, got %d %v", rw.Code, rw.Header())
+	}
+
+	rw = rateLimited(t, lb, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with Retry-After, got %d %v", rw.Code, rw.Header())
+	}
+
+	other := httptest.NewRequest("GET", "/", nil)
+	other.RemoteAddr = "198.51.100.1:1000"
+	if rw := rateLimited(t, lb, other); rw.Code != http.StatusOK {
+		t.Fatalf("the request of another client is rejected: %d", rw.Code)
+	}
+}
+
+func TestRateLimitJWTSubject(t *testing.T) {
+	lb := NewLoadBalancer(nil, nil, nil)
+	err := lb.SetRateLimits([]config.RateLimitConfig{{Key: "jwt", Rate: 1, Burst: 1}}, ratelimit.NewMemoryStore(), newTestJWTKeys(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := func(method jwt.SigningMethod, key []byte, sub string) *http.Request {
+		token, err := jwt.NewWithClaims(method, jwt.MapClaims{"sub": sub}).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	withSubject := func(sub string) *http.Request {
+		return signed(jwt.SigningMethodHS256, testJWTKey, sub)
+	}
+
+	// the clients share the address, but they are counted by the subject
+	if rw := rateLimited(t, lb, withSubject("alice")); rw.Code != http.StatusOK {
+		t.Fatalf("the first request is rejected: %d", rw.Code)
+	}
+	if rw := rateLimited(t, lb, withSubject("bob")); rw.Code != http.StatusOK {
+		t.Fatalf("the request of another subject is rejected: %d", rw.Code)
+	}
+	if rw := rateLimited(t, lb, withSubject("alice")); rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rw.Code)
+	}
+
+	// the forged tokens are counted by the address, which has got no requests yet
+	if rw := rateLimited(t, lb, signed(jwt.SigningMethodHS256, []byte("other key"), "carol")); rw.Code != http.StatusOK {
+		t.Fatalf("the first request of the address is rejected: %d", rw.Code)
+	}
+	if rw := rateLimited(t, lb, signed(jwt.SigningMethodHS512, testJWTKey, "dave")); rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the token of another method to be counted by the address, got %d", rw.Code)
+	}
+}
+
+func TestRateLimitJWTNeedsKey(t *testing.T) {
+	lb := NewLoadBalancer(nil, nil, nil)
+	err := lb.SetRateLimits([]config.RateLimitConfig{{Key: "jwt", Rate: 1, Burst: 1}}, ratelimit.NewMemoryStore(), nil)
+	if err == nil {
+		t.Fatal("expected an error without the keys of the tokens")
+	}
+}
+
+func TestRateLimitRefund(t *testing.T) {
+	lb := NewLoadBalancer(nil, nil, nil)
+	err := lb.SetRateLimits([]config.RateLimitConfig{
+		{Key: "ip", Rate: 1, Burst: 2},
+		{Path: "/search", Key: "route", Rate: 1, Burst: 1},
+	}, ratelimit.NewMemoryStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rw := rateLimited(t, lb, httptest.NewRequest("GET", "/search", nil)); rw.Code != http.StatusOK {
+		t.Fatalf("the first request is rejected: %d", rw.Code)
+	}
+	rw := rateLimited(t, lb, httptest.NewRequest("GET", "/search", nil))
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("RateLimit-Limit") != "1" {
+		t.Fatalf("expected 429 by the route limit, got %d %v", rw.Code, rw.Header())
+	}
+
+	// the token taken by the ip limit for the rejected request is returned
+	rw = rateLimited(t, lb, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusOK || rw.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("expected the last token of the address to be taken, got %d %v", rw.Code, rw.Header())
+	}
+}
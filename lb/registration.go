@@ -0,0 +1,191 @@
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+)
+
+const (
+	// registrationCheckPeriod is how often the leases of the registered backends are checked.
+	registrationCheckPeriod = time.Second
+
+	// drainTimeout is the maximal time of waiting for active requests
+	// of an expired backend.
+	drainTimeout = 30 * time.Second
+)
+
+// RegisterForm is a structure which is parsed from a POST-request
+// processed by RegisterServerHandler. TTL is set in milliseconds.
+type RegisterForm struct {
+	Url                   string
+	HealthCheckTcpTimeout int
+	MaximalRequests       int
+	TTL                   int64
+}
+
+// registrations keeps the leases of self-registered backends.
+type registrations struct {
+	mux    sync.Mutex
+	leases map[string]time.Time
+}
+
+func newRegistrations() *registrations {
+	return &registrations{
+		leases: make(map[string]time.Time),
+	}
+}
+
+// renew prolongs the lease if it exists.
+func (r *registrations) renew(url string, ttl time.Duration) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.leases[url]; !ok {
+		return false
+	}
+	r.leases[url] = time.Now().Add(ttl)
+	return true
+}
+
+func (r *registrations) add(url string, ttl time.Duration) {
+	r.mux.Lock()
+	r.leases[url] = time.Now().Add(ttl)
+	r.mux.Unlock()
+}
+
+func (r *registrations) remove(url string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	_, ok := r.leases[url]
+	delete(r.leases, url)
+	return ok
+}
+
+// expired removes and returns the leases that haven't been renewed in time.
+func (r *registrations) expired() []string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var urls []string
+	now := time.Now()
+	for url, deadline := range r.leases {
+		if now.After(deadline) {
+			urls = append(urls, url)
+			delete(r.leases, url)
+		}
+	}
+	return urls
+}
+
+// RegisterServerHandler lets a backend register itself in the server pool
+// with a TTL. Repeated POST-requests with the same URL are heartbeats renewing the TTL,
+// a POST-request of a draining backend cancels the drain.
+// If heartbeats stop, the backend is drained and removed, see RegistrationObserver.
+// DELETE-request deregisters the backend immediately with draining.
+func (lb *LoadBalancer) RegisterServerHandler(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		form := RegisterForm{}
+		if err := json.NewDecoder(req.Body).Decode(&form); err != nil {
+			http.Error(rw, "Couldn't parse JSON", http.StatusBadRequest)
+			return
+		}
+
+		if form.TTL <= 0 {
+			http.Error(rw, "Bad Request: TTL is below zero or equal", http.StatusBadRequest)
+			return
+		}
+		ttl := time.Duration(form.TTL) * time.Millisecond
+
+		if lb.registrations.renew(form.Url, ttl) {
+			_, _ = rw.Write([]byte("Renewed"))
+			return
+		}
+
+		if b := lb.Pool().FindServerByUrl(form.Url); b != nil {
+			if !b.Draining() {
+				http.Error(rw, "Server already exists", http.StatusPreconditionFailed)
+				return
+			}
+			// the backend is back before its drain has completed
+			b.SetDraining(false)
+			lb.registrations.add(form.Url, ttl)
+			_, _ = rw.Write([]byte("Renewed"))
+			return
+		}
+
+		if form.HealthCheckTcpTimeout <= 0 {
+			http.Error(rw, "Bad Request: timeout is below zero or equal", http.StatusBadRequest)
+			return
+		}
+
+		if form.MaximalRequests <= 0 {
+			http.Error(rw, "Bad Request: maxReq is below zero or equal", http.StatusBadRequest)
+			return
+		}
+		form.MaximalRequests %= 1 << int32BitsAmount
+
+		b := lb.pool.NewBackend(config.ServerConfig{
+			URL:                   form.Url,
+			HealthCheckTcpTimeout: int64(form.HealthCheckTcpTimeout),
+			MaximalRequests:       int32(form.MaximalRequests),
+		})
+		if b == nil {
+			http.Error(rw, "Bad URL", http.StatusBadRequest)
+			return
+		}
+
+		lb.registrations.add(form.Url, ttl)
+		lb.pool.AddServer(b)
+		lb.healthCheckFunc(b)
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write([]byte("Success!"))
+	case http.MethodDelete:
+		rem := RemoveForm{}
+		if err := json.NewDecoder(req.Body).Decode(&rem); err != nil {
+			http.Error(rw, "Couldn't parse JSON", http.StatusBadRequest)
+			return
+		}
+
+		if !lb.registrations.remove(rem.Url) {
+			http.Error(rw, "Server isn't registered", http.StatusNotFound)
+			return
+		}
+		go lb.drain(rem.Url)
+		rw.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(rw, "Only POST and DELETE requests are supported", http.StatusMethodNotAllowed)
+	}
+}
+
+// RegistrationObserver periodically drains and removes the registered
+// backends which haven't sent a heartbeat in time until ctx is done.
+func (lb *LoadBalancer) RegistrationObserver(ctx context.Context) {
+	ticker := time.NewTicker(registrationCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, url := range lb.registrations.expired() {
+			logger.Warnf("[%s] registration has expired", url)
+			go lb.drain(url)
+		}
+	}
+}
+
+func (lb *LoadBalancer) drain(url string) {
+	err := lb.pool.DrainServer(url, drainTimeout)
+	if errors.Is(err, backend.ErrDrainCanceled) {
+		logger.Infof("[%s] drain is canceled by registration", url)
+	} else if err != nil {
+		logger.Errorf("[%s] couldn't be drained: %v", url, err)
+	}
+}
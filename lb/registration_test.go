@@ -0,0 +1,135 @@
+package lb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+)
+
+const registeredURL = "http://127.0.0.1:9"
+
+func newRegistrationLB() *LoadBalancer {
+	return NewLoadBalancer(nil, nil, func(b *backend.Backend) { b.SetAlive(true) })
+}
+
+func register(lb *LoadBalancer, method, body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	lb.RegisterServerHandler(rw, httptest.NewRequest(method, "/serverPool/register", strings.NewReader(body)))
+	return rw
+}
+
+func registerForm(ttl string) string {
+	return `{"Url": "` + registeredURL + `", "HealthCheckTcpTimeout": 100, "MaximalRequests": 1, "TTL": ` + ttl + `}`
+}
+
+// waitRemoved waits for the backend to be removed from the pool.
+func waitRemoved(t *testing.T, lb *LoadBalancer, timeout time.Duration) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if lb.Pool().FindServerByUrl(registeredURL) == nil {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestRegisterAndRenew(t *testing.T) {
+	lb := newRegistrationLB()
+
+	if rw := register(lb, http.MethodPost, registerForm("60000")); rw.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d %s", rw.Code, rw.Body)
+	}
+	b := lb.Pool().FindServerByUrl(registeredURL)
+	if b == nil || !b.Alive() {
+		t.Fatal("the registered backend isn't in the pool or isn't checked")
+	}
+
+	if rw := register(lb, http.MethodPost, registerForm("60000")); rw.Code != http.StatusOK || rw.Body.String() != "Renewed" {
+		t.Fatalf("expected the lease to be renewed, got %d %s", rw.Code, rw.Body)
+	}
+	if rw := register(lb, http.MethodPost, registerForm("0")); rw.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for zero TTL, got %d", rw.Code)
+	}
+}
+
+func TestRegisterExistingServer(t *testing.T) {
+	lb := newRegistrationLB()
+	lb.Pool().AddServer(backend.NewBackend(mustParseURL(t, registeredURL), time.Second, 1))
+
+	if rw := register(lb, http.MethodPost, registerForm("60000")); rw.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a configured server, got %d", rw.Code)
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	lb := newRegistrationLB()
+	register(lb, http.MethodPost, registerForm("60000"))
+
+	body := `{"Url": "` + registeredURL + `"}`
+	if rw := register(lb, http.MethodDelete, body); rw.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", rw.Code)
+	}
+	if !waitRemoved(t, lb, time.Second) {
+		t.Fatal("the deregistered backend isn't removed")
+	}
+	if rw := register(lb, http.MethodDelete, body); rw.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a removed backend, got %d", rw.Code)
+	}
+}
+
+func TestRegisterCancelsDrain(t *testing.T) {
+	lb := newRegistrationLB()
+	register(lb, http.MethodPost, registerForm("60000"))
+
+	// the active request keeps the backend draining
+	b := lb.Pool().FindServerByUrl(registeredURL)
+	if !b.AssignRequest() {
+		t.Fatal("the request slot isn't taken")
+	}
+	register(lb, http.MethodDelete, `{"Url": "`+registeredURL+`"}`)
+	time.Sleep(50 * time.Millisecond)
+	if !b.Draining() {
+		t.Fatal("the backend isn't draining")
+	}
+
+	if rw := register(lb, http.MethodPost, registerForm("60000")); rw.Code != http.StatusOK {
+		t.Fatalf("expected the drain to be canceled with 200, got %d %s", rw.Code, rw.Body)
+	}
+	b.Free()
+	if waitRemoved(t, lb, 300*time.Millisecond) {
+		t.Fatal("the backend is removed after the drain is canceled")
+	}
+	if b.Draining() {
+		t.Fatal("the backend is still draining")
+	}
+}
+
+func TestRegistrationExpiry(t *testing.T) {
+	lb := newRegistrationLB()
+	register(lb, http.MethodPost, registerForm("100"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.RegistrationObserver(ctx)
+
+	if !waitRemoved(t, lb, registrationCheckPeriod+time.Second) {
+		t.Fatal("the backend isn't removed after its lease has expired")
+	}
+}
+
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
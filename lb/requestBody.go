@@ -0,0 +1,23 @@
+package lb
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// requestBody counts bytes of the request body while it's streamed to the backend.
+type requestBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// Size returns how many bytes have been read.
+func (b *requestBody) Size() int64 {
+	return b.n.Load()
+}
@@ -0,0 +1,86 @@
+package lb
+
+import (
+	"crypto/x509"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pelageech/BDUTS/config"
+)
+
+// defaultRoute is used if no route matches the request.
+var defaultRoute = &config.RouteConfig{Path: "/"}
+
+// routeTable matches requests with the route of the longest path prefix.
+type routeTable struct {
+	routes    []config.RouteConfig
+	hedgers   map[string]*hedger
+	clientCAs map[string][]*x509.Certificate
+}
+
+func newRouteTable(routes []config.RouteConfig) (*routeTable, error) {
+	sorted := make([]config.RouteConfig, len(routes))
+	copy(sorted, routes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Path) > len(sorted[j].Path)
+	})
+
+	hedgers := make(map[string]*hedger)
+	clientCAs := make(map[string][]*x509.Certificate)
+	for _, r := range sorted {
+		if r.Hedging != nil {
+			hedgers[r.Path] = newHedger(r.Hedging)
+		}
+		if r.ClientCAFile != "" {
+			cas, err := loadClientCAs(r.ClientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			clientCAs[r.Path] = cas
+		}
+	}
+	return &routeTable{routes: sorted, hedgers: hedgers, clientCAs: clientCAs}, nil
+}
+
+func (t *routeTable) match(path string) *config.RouteConfig {
+	for i := range t.routes {
+		if matchPath(path, t.routes[i].Path) {
+			return &t.routes[i]
+		}
+	}
+	return defaultRoute
+}
+
+// matchPath reports whether path is prefix or lies under it,
+// so "/api" matches "/api" and "/api/users" but not "/apiv2".
+func matchPath(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// hedger returns the hedger of the route or nil if its requests aren't hedged.
+func (t *routeTable) hedger(route *config.RouteConfig) *hedger {
+	return t.hedgers[route.Path]
+}
+
+// clientCertAllowed returns true if the route accepts the client certificate of req.
+func (t *routeTable) clientCertAllowed(route *config.RouteConfig, req *http.Request) bool {
+	if !route.RequireClientCert && route.ClientCAFile == "" {
+		return true
+	}
+	if verifiedClientCert(req) == nil {
+		return false
+	}
+	cas, ok := t.clientCAs[route.Path]
+	return !ok || issuedBy(req, cas)
+}
+
+// SetRoutes sets the settings of the requests by their path.
+func (lb *LoadBalancer) SetRoutes(routes []config.RouteConfig) error {
+	t, err := newRouteTable(routes)
+	if err != nil {
+		return err
+	}
+	lb.routes = t
+	return nil
+}
@@ -0,0 +1,53 @@
+package lb
+
+import (
+	"testing"
+
+	"github.com/pelageech/BDUTS/config"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"/api", "/api", true},
+		{"/api/", "/api", true},
+		{"/api/users", "/api", true},
+		{"/apiv2", "/api", false},
+		{"/ap", "/api", false},
+		{"/api/users", "/api/", true},
+		{"/api", "/api/", false},
+		{"/", "/", true},
+		{"/anything", "/", true},
+	}
+	for _, tt := range tests {
+		if got := matchPath(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestRouteTableMatch(t *testing.T) {
+	table, err := newRouteTable([]config.RouteConfig{
+		{Path: "/"},
+		{Path: "/api"},
+		{Path: "/api/upload"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"/":                "/",
+		"/apiv2":           "/",
+		"/api":             "/api",
+		"/api/users":       "/api",
+		"/api/uploads":     "/api",
+		"/api/upload/file": "/api/upload",
+	}
+	for path, want := range tests {
+		if got := table.match(path).Path; got != want {
+			t.Errorf("match(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
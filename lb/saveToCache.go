@@ -1,20 +1,63 @@
 package lb
 
 import (
+	"bytes"
+	"context"
 	"net/http"
 
 	"github.com/pelageech/BDUTS/cache"
 )
 
+// cacheCapture collects the response body streamed to the client
+// for saving it in cache. It stops collecting if the body exceeds the limit,
+// writing never fails for not interrupting the stream.
+type cacheCapture struct {
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (c *cacheCapture) Write(p []byte) (int, error) {
+	if c.overflow {
+		return len(p), nil
+	}
+	if int64(c.buf.Len()+len(p)) > c.limit {
+		c.overflow = true
+		c.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+// newCacheCapture returns nil if the response can't be saved in cache,
+// so there's no need to collect its body.
+func (lb *LoadBalancer) newCacheCapture(req *http.Request, resp *http.Response) *cacheCapture {
+	limit := lb.config.MaxCacheableSize()
+	if !isCacheableStatus(resp.StatusCode) || resp.ContentLength > limit {
+		return nil
+	}
+	return &cacheCapture{limit: limit}
+}
+
+func isCacheableStatus(status int) bool {
+	return status >= 200 && status < 400
+}
+
 // SaveToCache takes all the necessary information about a response and saves it
-// in cache.
+// in cache. The page is written in background, see WaitCacheWrites.
 func (lb *LoadBalancer) SaveToCache(req *http.Request, resp *http.Response, byteArray []byte) {
-	if !(resp.StatusCode >= 200 && resp.StatusCode < 400) {
+	if !isCacheableStatus(resp.StatusCode) {
+		return
+	}
+	// the handlers which outlive the shutdown timeout don't write to the closed databases
+	if !lb.cacheWrites.Add(nil) {
+		logger.Warn("Response isn't saved in cache: shutting down")
 		return
 	}
 	logger.Info("Saving response in cache")
 
 	go func() {
+		defer lb.cacheWrites.Done(nil)
 		cacheItem := &cache.Page{
 			Body:   byteArray,
 			Header: resp.Header,
@@ -32,3 +75,10 @@ func (lb *LoadBalancer) SaveToCache(req *http.Request, resp *http.Response, byte
 		logger.Info("Successfully saved")
 	}()
 }
+
+// WaitCacheWrites waits for the responses being saved in cache until ctx is done.
+// It's used on shutdown after the requests have been completed,
+// the responses of the requests still in flight aren't saved.
+func (lb *LoadBalancer) WaitCacheWrites(ctx context.Context) error {
+	return lb.cacheWrites.Wait(ctx)
+}
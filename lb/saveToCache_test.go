@@ -0,0 +1,36 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewCacheCapture(t *testing.T) {
+	lb := NewLoadBalancer(NewLoadBalancerConfig(0, 0, 0, 0, 0), nil, nil)
+	limit := lb.config.MaxCacheableSize()
+
+	tests := []struct {
+		name    string
+		method  string
+		status  int
+		length  int64
+		capture bool
+	}{
+		{"get", http.MethodGet, http.StatusOK, 10, true},
+		{"post", http.MethodPost, http.StatusOK, 10, true},
+		{"unknown length", http.MethodGet, http.StatusOK, -1, true},
+		{"redirect", http.MethodGet, http.StatusFound, 0, true},
+		{"error", http.MethodGet, http.StatusNotFound, 10, false},
+		{"too large", http.MethodGet, http.StatusOK, limit + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			resp := &http.Response{StatusCode: tt.status, ContentLength: tt.length}
+			if got := lb.newCacheCapture(req, resp) != nil; got != tt.capture {
+				t.Errorf("expected capturing %v, got %v", tt.capture, got)
+			}
+		})
+	}
+}
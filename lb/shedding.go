@@ -0,0 +1,179 @@
+package lb
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/metrics"
+	"github.com/pelageech/BDUTS/realip"
+)
+
+// retryAfterShed is Retry-After of the rejected requests, in seconds.
+const retryAfterShed = "1"
+
+type priority int
+
+const (
+	priorityLow priority = iota
+	priorityNormal
+	priorityHigh
+	priorityCritical
+)
+
+// sheddingLoad is the load from which the requests of a priority are rejected,
+// critical requests are never rejected.
+var sheddingLoad = map[priority]float64{
+	priorityLow:    1,
+	priorityNormal: 1.2,
+	priorityHigh:   1.5,
+}
+
+var priorityNames = map[priority]string{
+	priorityLow:      "low",
+	priorityNormal:   "normal",
+	priorityHigh:     "high",
+	priorityCritical: "critical",
+}
+
+func (p priority) String() string {
+	return priorityNames[p]
+}
+
+// parsePriority returns false for an empty name.
+func parsePriority(name string) (priority, bool, error) {
+	if name == "" {
+		return 0, false, nil
+	}
+	for p, n := range priorityNames {
+		if strings.EqualFold(name, n) {
+			return p, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("unknown priority %q", name)
+}
+
+type clientPriority struct {
+	addresses *realip.Resolver
+	priority  priority
+}
+
+// loadShedder rejects the requests of low priorities when the balancer is overloaded.
+type loadShedder struct {
+	cpu        float64
+	goroutines int
+	queueDepth int
+
+	header  string
+	clients []clientPriority
+
+	inFlight atomic.Int64
+}
+
+// SetLoadShedding turns load shedding on, nil turns it off.
+func (lb *LoadBalancer) SetLoadShedding(c *config.LoadSheddingConfig) error {
+	if c == nil {
+		lb.shedder = nil
+		return nil
+	}
+
+	s := &loadShedder{
+		cpu:        c.CPU,
+		goroutines: c.Goroutines,
+		queueDepth: c.QueueDepth,
+		header:     c.PriorityHeader,
+	}
+	for _, client := range c.Clients {
+		p, ok, err := parsePriority(client.Priority)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("no priority of clients %v", client.Addresses)
+		}
+		addresses, err := realip.NewResolver(client.Addresses)
+		if err != nil {
+			return err
+		}
+		s.clients = append(s.clients, clientPriority{addresses: addresses, priority: p})
+	}
+	for _, route := range lb.routes.routes {
+		if _, _, err := parsePriority(route.Priority); err != nil {
+			return fmt.Errorf("route %s: %w", route.Path, err)
+		}
+	}
+	lb.shedder = s
+	return nil
+}
+
+// load returns the largest ratio of a load signal to its threshold.
+func (s *loadShedder) load() float64 {
+	var load float64
+	if s.cpu > 0 {
+		load = math.Max(load, metrics.CPUPercent()/s.cpu)
+	}
+	if s.goroutines > 0 {
+		load = math.Max(load, float64(runtime.NumGoroutine())/float64(s.goroutines))
+	}
+	if s.queueDepth > 0 {
+		load = math.Max(load, float64(s.inFlight.Load())/float64(s.queueDepth))
+	}
+	return load
+}
+
+// priority classifies the request by the route, the header set by a trusted proxy
+// and the client address. The requests are normal by default.
+func (lb *LoadBalancer) priority(req *http.Request, route *config.RouteConfig) priority {
+	if p, ok, _ := parsePriority(route.Priority); ok {
+		return p
+	}
+
+	s := lb.shedder
+	if s.header != "" && lb.clientIPResolver.IsTrusted(realip.PeerIP(req)) {
+		if p, ok, err := parsePriority(req.Header.Get(s.header)); ok && err == nil {
+			return p
+		}
+	}
+
+	if client, ok := realip.FromContext(req.Context()); ok {
+		for _, c := range s.clients {
+			if c.addresses.IsTrusted(client) {
+				return c.priority
+			}
+		}
+	}
+	return priorityNormal
+}
+
+// shed checks if the request must be rejected because of the load.
+// The priority header is removed after the request is classified,
+// it's meant only for the balancer.
+func (lb *LoadBalancer) shed(req *http.Request, route *config.RouteConfig) bool {
+	if lb.shedder == nil {
+		return false
+	}
+	p := lb.priority(req, route)
+	if lb.shedder.header != "" {
+		req.Header.Del(lb.shedder.header)
+	}
+	threshold, ok := sheddingLoad[p]
+	if !ok || lb.shedder.load() < threshold {
+		return false
+	}
+	metrics.UpdateShedRequests(p.String())
+	return true
+}
+
+// trackInFlight counts the request in the queue depth until the returned func is called.
+func (lb *LoadBalancer) trackInFlight() func() {
+	s := lb.shedder
+	if s == nil {
+		return func() {}
+	}
+	s.inFlight.Add(1)
+	return func() { s.inFlight.Add(-1) }
+}
@@ -0,0 +1,106 @@
+package lb
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/metrics"
+	"github.com/pelageech/BDUTS/realip"
+)
+
+func TestMain(m *testing.M) {
+	metrics.Init(0, 0)
+	m.Run()
+}
+
+func newShedding(t *testing.T) *LoadBalancer {
+	t.Helper()
+	lb := NewLoadBalancer(nil, nil, nil)
+	if err := lb.SetRoutes([]config.RouteConfig{{Path: "/healthz", Priority: "critical"}}); err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := realip.NewResolver([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.SetClientIPResolver(resolver)
+	err = lb.SetLoadShedding(&config.LoadSheddingConfig{
+		QueueDepth:     10,
+		PriorityHeader: "X-Priority",
+		Clients:        []config.ClientPriorityConfig{{Addresses: []string{"192.0.2.0/24"}, Priority: "low"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+func TestPriority(t *testing.T) {
+	lb := newShedding(t)
+	for _, tt := range []struct {
+		path, peer, header string
+		expected           priority
+	}{
+		{"/", "198.51.100.1:1000", "", priorityNormal},
+		{"/healthz", "192.0.2.1:1000", "", priorityCritical},
+		{"/", "192.0.2.1:1000", "", priorityLow},
+		{"/", "10.0.0.1:1000", "high", priorityHigh},
+		// only trusted proxies may set the priority
+		{"/", "198.51.100.1:1000", "critical", priorityNormal},
+	} {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.RemoteAddr = tt.peer
+		req.Header.Set("X-Priority", tt.header)
+		lb.setForwardedHeaders(req)
+		if p := lb.priority(req, lb.routes.match(tt.path)); p != tt.expected {
+			t.Errorf("%s from %s with %q: expected %s, got %s", tt.path, tt.peer, tt.header, tt.expected, p)
+		}
+	}
+}
+
+func TestShed(t *testing.T) {
+	lb := newShedding(t)
+	low := httptest.NewRequest("GET", "/", nil)
+	low.RemoteAddr = "192.0.2.1:1000"
+	lb.setForwardedHeaders(low)
+	normal := httptest.NewRequest("GET", "/", nil)
+	normal.RemoteAddr = "198.51.100.1:1000"
+	lb.setForwardedHeaders(normal)
+	critical := httptest.NewRequest("GET", "/healthz", nil)
+
+	// 11 requests in flight is the load of 1.1
+	for i := 0; i < 11; i++ {
+		defer lb.trackInFlight()()
+	}
+	if !lb.shed(low, lb.routes.match("/")) {
+		t.Error("the low priority request isn't rejected")
+	}
+	if lb.shed(normal, lb.routes.match("/")) {
+		t.Error("the normal priority request is rejected")
+	}
+
+	for i := 0; i < 100; i++ {
+		defer lb.trackInFlight()()
+	}
+	if !lb.shed(normal, lb.routes.match("/")) {
+		t.Error("the normal priority request isn't rejected")
+	}
+	if lb.shed(critical, lb.routes.match("/healthz")) {
+		t.Error("the critical request is rejected")
+	}
+}
+
+func TestShedRemovesPriorityHeader(t *testing.T) {
+	lb := newShedding(t)
+	for _, path := range []string{"/", "/healthz"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		req.Header.Set("X-Priority", "high")
+		lb.setForwardedHeaders(req)
+		lb.shed(req, lb.routes.match(path))
+		if v := req.Header.Get("X-Priority"); v != "" {
+			t.Errorf("%s: the priority header is forwarded: %q", path, v)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package lb
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+)
+
+// withTimeout limits the request by the route timeout and by the deadline
+// sent by the client or a proxy in front, whichever is earlier.
+func withTimeout(req *http.Request, route *config.RouteConfig) (*http.Request, context.CancelFunc) {
+	timeout := time.Duration(route.Timeout) * time.Millisecond
+	if d, ok := requestedTimeout(req.Header); ok && (timeout == 0 || d < timeout) {
+		timeout = d
+	}
+	if timeout == 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel
+}
+
+// withTryTimeout limits a request to the backend by the route and the backend timeouts.
+func withTryTimeout(req *http.Request, route *config.RouteConfig, server *backend.Backend) (*http.Request, context.CancelFunc) {
+	timeout := time.Duration(route.TryTimeout) * time.Millisecond
+	if d := server.Timeout(); d > 0 && (timeout == 0 || d < timeout) {
+		timeout = d
+	}
+	if timeout == 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel
+}
+
+// requestedTimeout returns the time the client is going to wait for the response.
+func requestedTimeout(h http.Header) (time.Duration, bool) {
+	if v := h.Get(backend.GRPCTimeoutHeader); v != "" {
+		if d, ok := backend.ParseGRPCTimeout(v); ok && d > 0 {
+			return d, true
+		}
+	}
+	if v := h.Get(backend.RequestTimeoutHeader); v != "" {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms > 0 {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+	}
+	return 0, false
+}
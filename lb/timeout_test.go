@@ -0,0 +1,187 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+)
+
+func TestRequestedTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   time.Duration
+		ok     bool
+	}{
+		{name: "none"},
+		{name: "grpc", header: map[string]string{backend.GRPCTimeoutHeader: "150m"}, want: 150 * time.Millisecond, ok: true},
+		{name: "request", header: map[string]string{backend.RequestTimeoutHeader: "250"}, want: 250 * time.Millisecond, ok: true},
+		{name: "grpc first", header: map[string]string{
+			backend.GRPCTimeoutHeader:    "1S",
+			backend.RequestTimeoutHeader: "250",
+		}, want: time.Second, ok: true},
+		{name: "invalid grpc", header: map[string]string{
+			backend.GRPCTimeoutHeader:    "1s",
+			backend.RequestTimeoutHeader: "250",
+		}, want: 250 * time.Millisecond, ok: true},
+		{name: "zero grpc", header: map[string]string{backend.GRPCTimeoutHeader: "0m"}},
+		{name: "zero", header: map[string]string{backend.RequestTimeoutHeader: "0"}},
+		{name: "negative", header: map[string]string{backend.RequestTimeoutHeader: "-5"}},
+		{name: "invalid", header: map[string]string{backend.RequestTimeoutHeader: "soon"}},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for key, value := range tt.header {
+			h.Set(key, value)
+		}
+		got, ok := requestedTimeout(h)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: requestedTimeout() = %s, %v, want %s, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		route     config.RouteConfig
+		requested string
+		want      time.Duration
+	}{
+		{name: "none"},
+		{name: "route", route: config.RouteConfig{Timeout: 2000}, want: 2 * time.Second},
+		{name: "requested", requested: "3000", want: 3 * time.Second},
+		{name: "requested is earlier", route: config.RouteConfig{Timeout: 2000}, requested: "1000", want: time.Second},
+		{name: "route is earlier", route: config.RouteConfig{Timeout: 2000}, requested: "5000", want: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.requested != "" {
+			req.Header.Set(backend.RequestTimeoutHeader, tt.requested)
+		}
+		limited, cancel := withTimeout(req, &tt.route)
+		expectTimeout(t, tt.name, limited, tt.want)
+		cancel()
+	}
+}
+
+func TestWithTryTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   config.RouteConfig
+		backend int64
+		want    time.Duration
+	}{
+		{name: "none"},
+		{name: "route", route: config.RouteConfig{TryTimeout: 2000}, want: 2 * time.Second},
+		{name: "backend", backend: 3000, want: 3 * time.Second},
+		{name: "backend is earlier", route: config.RouteConfig{TryTimeout: 2000}, backend: 1000, want: time.Second},
+		{name: "route is earlier", route: config.RouteConfig{TryTimeout: 2000}, backend: 5000, want: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		server := backend.NewBackendConfig(config.ServerConfig{URL: "http://127.0.0.1:1", MaximalRequests: 1, Timeout: tt.backend})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		limited, cancel := withTryTimeout(req, &tt.route, server)
+		expectTimeout(t, tt.name, limited, tt.want)
+		cancel()
+	}
+}
+
+// expectTimeout checks the deadline of req, zero want means no deadline.
+func expectTimeout(t *testing.T, name string, req *http.Request, want time.Duration) {
+	t.Helper()
+	deadline, ok := req.Context().Deadline()
+	if want == 0 {
+		if ok {
+			t.Errorf("%s: unexpected deadline in %s", name, time.Until(deadline))
+		}
+		return
+	}
+	if !ok {
+		t.Errorf("%s: no deadline, want %s", name, want)
+		return
+	}
+	if left := time.Until(deadline); left > want || left < want-time.Second/2 {
+		t.Errorf("%s: deadline in %s, want %s", name, left, want)
+	}
+}
+
+// TestBackendHandlerTimeout sends requests to a backend answering the first slow ones
+// only after they are canceled.
+func TestBackendHandlerTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		route  config.RouteConfig
+		slow   int32
+		status int
+		tries  int32
+	}{
+		{
+			name:   "retried within the total timeout",
+			route:  config.RouteConfig{Path: "/", Timeout: 5000, TryTimeout: 100},
+			slow:   1,
+			status: http.StatusOK,
+			tries:  2,
+		},
+		{
+			name:   "not retried without the total timeout",
+			route:  config.RouteConfig{Path: "/", TryTimeout: 100},
+			slow:   1,
+			status: http.StatusGatewayTimeout,
+			tries:  1,
+		},
+		{
+			name:   "total timeout",
+			route:  config.RouteConfig{Path: "/", Timeout: 100},
+			slow:   2,
+			status: http.StatusGatewayTimeout,
+			tries:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tries atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if tries.Add(1) <= tt.slow {
+					select {
+					case <-req.Context().Done():
+					case <-time.After(5 * time.Second):
+					}
+					return
+				}
+				_, _ = io.WriteString(rw, "ok")
+			}))
+			defer server.Close()
+
+			lb := NewLoadBalancer(NewLoadBalancerConfig(0, 0, 0, 0, 0), nil, nil)
+			if err := lb.SetRoutes([]config.RouteConfig{tt.route}); err != nil {
+				t.Fatal(err)
+			}
+			b := backend.NewBackend(mustParseURL(t, server.URL), time.Second, 1)
+			b.SetAlive(true)
+			lb.Pool().AddServer(b)
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req, cancel := withTimeout(req, &tt.route)
+			defer cancel()
+			_ = lb.backendHandler(rw, req)
+
+			if rw.Code != tt.status {
+				t.Errorf("expected %d, got %d", tt.status, rw.Code)
+			}
+			if n := tries.Load(); n != tt.tries {
+				t.Errorf("expected %d tries, got %d", tt.tries, n)
+			}
+			if !b.Alive() {
+				t.Error("the slow backend is marked as dead")
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+)
+
+// upgradeHandler proxies requests with `Connection: Upgrade`, e.g. WebSocket handshakes.
+// If the backend switches the protocol, the client connection is hijacked and
+// the bytes are spliced in both directions until one of the sides closes.
+// The upgraded connection holds a request slot of the backend all its life.
+// The timeouts of the route and the backend limit only the handshake.
+func (lb *LoadBalancer) upgradeHandler(rw http.ResponseWriter, req *http.Request, route *config.RouteConfig) error {
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "Upgrade is supported only by HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return errors.New("connection can't be hijacked")
+	}
+
+ChooseServer:
+	server, err := lb.pool.GetNextPeer()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return err
+	}
+	if ok := server.AssignRequest(); !ok {
+		goto ChooseServer
+	}
+
+	handshakeReq, cancel := withTimeout(req, route)
+	handshakeReq, cancelTry := withTryTimeout(handshakeReq, route, server)
+	backendConn, resp, err := server.DialUpgrade(handshakeReq)
+	cancelTry()
+	cancel()
+	if err != nil {
+		server.Free()
+		// the client has gone, it isn't the backend's fault
+		if errors.Is(err, context.Canceled) {
+			return fmt.Errorf("[%s]: %w", server.URL(), err)
+		}
+		// a slow backend isn't dead
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			logger.Warnf("[%s] timed out\n", server.URL())
+			http.Error(rw, "Gateway Timeout", http.StatusGatewayTimeout)
+			return fmt.Errorf("[%s]: %w", server.URL(), err)
+		}
+		logger.Errorf("[%s] %s", server.URL(), err)
+		server.SetAlive(false)
+		goto ChooseServer
+	}
+	defer server.Free()
+	defer backendConn.Close()
+
+	logger.Infof("[%s] returned %s\n", server.URL(), resp.Status)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		backend.RemoveHopByHopHeaders(resp.Header)
+		for key, values := range resp.Header {
+			for _, value := range values {
+				rw.Header().Add(key, value)
+			}
+		}
+		rw.WriteHeader(resp.StatusCode)
+		_, err := io.Copy(rw, resp.Body)
+		return err
+	}
+
+	clientConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return fmt.Errorf("[%s]: %w", server.URL(), err)
+	}
+	defer clientConn.Close()
+
+	// the HTTP server doesn't wait for hijacked connections, see WaitUpgradedConnections
+	if !lb.upgraded.Add(clientConn) {
+		return fmt.Errorf("[%s]: %w", server.URL(), errShuttingDown)
+	}
+	defer lb.upgraded.Done(clientConn)
+
+	// the deadlines of the HTTP server mustn't limit the upgraded connection
+	_ = clientConn.SetDeadline(time.Time{})
+
+	resp.Body = nil
+	if err := resp.Write(brw); err != nil {
+		return fmt.Errorf("[%s]: %w", server.URL(), err)
+	}
+	if err := brw.Flush(); err != nil {
+		return fmt.Errorf("[%s]: %w", server.URL(), err)
+	}
+
+	server.UpdateUpgradedConnections(1)
+	defer server.UpdateUpgradedConnections(-1)
+
+	// the client may have sent some bytes after the handshake, they are in brw
+	splice(&readerConn{Conn: clientConn, r: brw}, backendConn)
+	logger.Infof("[%s] upgraded connection is closed\n", server.URL())
+	return nil
+}
+
+// errShuttingDown is returned for the connections upgraded after the shutdown has started.
+var errShuttingDown = errors.New("the load balancer is shutting down")
+
+// WaitUpgradedConnections waits for the upgraded connections to be closed by the peers
+// until ctx is done, then the connections left are closed.
+// No connection is upgraded after the call.
+func (lb *LoadBalancer) WaitUpgradedConnections(ctx context.Context) error {
+	return lb.upgraded.Wait(ctx)
+}
+
+// splice copies bytes between the connections in both directions.
+// When one of the directions is finished, both connections are closed.
+func splice(a, b net.Conn) {
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+	wg.Wait()
+}
+
+// readerConn is net.Conn reading through r.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
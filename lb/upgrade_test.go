@@ -0,0 +1,205 @@
+package lb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/backend"
+	"github.com/pelageech/BDUTS/config"
+)
+
+// echoUpgradeServer switches to an echo protocol on `Upgrade: echo`.
+func echoUpgradeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "echo" {
+			http.Error(rw, "Upgrade Required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = brw.Flush()
+		_, _ = io.Copy(conn, brw)
+	}))
+}
+
+// hijackRecorder lets the handler pass the Hijacker check,
+// the connection isn't hijacked if the protocol isn't switched.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("not supported by the recorder")
+}
+
+func newUpgradeLB(t *testing.T, backendURL string) (*LoadBalancer, *backend.Backend) {
+	t.Helper()
+	lb := NewLoadBalancer(nil, nil, nil)
+	b := backend.NewBackend(mustParseURL(t, backendURL), time.Second, 1)
+	b.SetAlive(true)
+	lb.Pool().AddServer(b)
+	return lb, b
+}
+
+func TestUpgrade(t *testing.T) {
+	server := echoUpgradeServer(t)
+	defer server.Close()
+	lb, _ := newUpgradeLB(t, server.URL)
+	front := httptest.NewServer(http.HandlerFunc(lb.LoadBalancerHandler))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("expected 101 with `Upgrade: echo`, got %s %v", resp.Status, resp.Header)
+	}
+
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("ping"))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("expected the bytes to be echoed, got %q", got)
+	}
+}
+
+func TestUpgradeNotSwitched(t *testing.T) {
+	server := echoUpgradeServer(t)
+	defer server.Close()
+	lb, _ := newUpgradeLB(t, server.URL)
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "other")
+	rw := httptest.NewRecorder()
+	lb.LoadBalancerHandler(hijackRecorder{rw}, req)
+
+	if rw.Code != http.StatusUpgradeRequired {
+		t.Fatalf("expected the response of the backend, got %d", rw.Code)
+	}
+}
+
+func TestUpgradeCanceled(t *testing.T) {
+	server := echoUpgradeServer(t)
+	defer server.Close()
+	lb, b := newUpgradeLB(t, server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil).WithContext(ctx)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	lb.LoadBalancerHandler(hijackRecorder{httptest.NewRecorder()}, req)
+
+	if !b.Alive() {
+		t.Fatal("the backend is marked dead because of a canceled client")
+	}
+}
+
+func TestUpgradeTimeout(t *testing.T) {
+	// the backend accepts the connection but never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	lb, b := newUpgradeLB(t, "http://"+ln.Addr().String())
+	if err := lb.SetRoutes([]config.RouteConfig{{Path: "/ws", TryTimeout: 100}}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	rw := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.LoadBalancerHandler(hijackRecorder{rw}, req)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake isn't limited by the timeout")
+	}
+	if rw.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rw.Code)
+	}
+	if !b.Alive() {
+		t.Fatal("the backend is marked dead because of a timeout")
+	}
+}
+
+func TestWaitUpgradedConnections(t *testing.T) {
+	server := echoUpgradeServer(t)
+	defer server.Close()
+	lb, _ := newUpgradeLB(t, server.URL)
+	front := httptest.NewServer(http.HandlerFunc(lb.LoadBalancerHandler))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %v %v", resp, err)
+	}
+
+	// the connection is open, so it's closed after the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := lb.WaitUpgradedConnections(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the upgraded connection to be closed, got %v", err)
+	}
+}
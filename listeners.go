@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pelageech/BDUTS/certs"
+	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/metrics"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	clientAuthRequire  = "require"
+	clientAuthOptional = "optional"
+
+	purposeProxy   = "proxy"
+	purposeAdmin   = "admin"
+	purposeMetrics = "metrics"
+
+	metricsPath           = "/metrics"
+	defaultMetricsAddress = ":8081"
+	defaultHTTPSPort      = 443
+
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+// defaultListeners are used if the listeners aren't configured:
+// the proxy and the admin API over TLS on port, the metrics on :8081.
+func defaultListeners(port int) []config.ListenerConfig {
+	return []config.ListenerConfig{
+		{Address: fmt.Sprintf(":%d", port), TLS: true, Purposes: []string{purposeProxy, purposeAdmin}},
+		{Address: defaultMetricsAddress, Purposes: []string{purposeMetrics}},
+	}
+}
+
+// listenerHandler builds the handler serving the purposes of the listener.
+// A listener with the only purpose "metrics" serves them on any path, otherwise on /metrics.
+// Plain-HTTP listeners may redirect to HTTPS and answer ACME challenges instead.
+func listenerHandler(
+	c config.ListenerConfig,
+	proxy http.Handler,
+	admin map[string]http.Handler,
+	acmeClient *certs.ACME,
+) (http.Handler, error) {
+	if c.TLS && (c.RedirectToHTTPS || c.ACMEChallenges) {
+		return nil, fmt.Errorf("TLS listener %s can't redirect to HTTPS or answer ACME challenges", c.Address)
+	}
+	if c.RedirectToHTTPS && len(c.Purposes) > 0 {
+		return nil, fmt.Errorf("listener %s redirects to HTTPS, it can't have purposes", c.Address)
+	}
+	if !c.RedirectToHTTPS && len(c.Purposes) == 0 {
+		return nil, fmt.Errorf("listener %s has no purposes", c.Address)
+	}
+
+	var handler http.Handler
+	switch {
+	case c.RedirectToHTTPS:
+		handler = redirectToHTTPS(c.HTTPSPort)
+	case len(c.Purposes) == 1 && c.Purposes[0] == purposeMetrics:
+		handler = metrics.Handler()
+	default:
+		mux := http.NewServeMux()
+		for _, purpose := range c.Purposes {
+			switch purpose {
+			case purposeProxy:
+				mux.Handle("/", proxy)
+			case purposeAdmin:
+				for pattern, h := range admin {
+					mux.Handle(pattern, h)
+				}
+			case purposeMetrics:
+				mux.Handle(metricsPath, metrics.Handler())
+			default:
+				return nil, fmt.Errorf("unknown purpose %q of %s", purpose, c.Address)
+			}
+		}
+		handler = mux
+	}
+
+	if c.ACMEChallenges {
+		if acmeClient == nil {
+			return nil, fmt.Errorf("listener %s answers ACME challenges, but ACME isn't configured", c.Address)
+		}
+		handler = acmeClient.HTTPHandler(handler)
+	}
+	return handler, nil
+}
+
+// redirectToHTTPS redirects the requests to the same host and path over HTTPS.
+func redirectToHTTPS(httpsPort int) http.Handler {
+	if httpsPort == 0 {
+		httpsPort = defaultHTTPSPort
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != defaultHTTPSPort {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(rw, req, "https://"+host+req.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// newListenerServer creates a server for the listener. TLS listeners negotiate HTTP/2
+// by ALPN, plain ones accept h2c if it's enabled.
+func newListenerServer(
+	c config.ListenerConfig,
+	handler http.Handler,
+	enableH2C bool,
+	limits *config.DownstreamConfig,
+) (*http.Server, error) {
+	server := newServer(limits)
+	if !c.TLS {
+		if enableH2C {
+			handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: server.IdleTimeout})
+		}
+		server.Handler = handler
+		return server, nil
+	}
+
+	server.Handler = handler
+	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// newServer creates a server with the timeouts guarding against slow clients.
+// The write timeout also limits streamed responses, so it's off by default.
+func newServer(limits *config.DownstreamConfig) *http.Server {
+	server := &http.Server{
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+		IdleTimeout:       defaultIdleTimeout,
+	}
+	if limits == nil {
+		return server
+	}
+	if limits.ReadHeaderTimeout > 0 {
+		server.ReadHeaderTimeout = time.Duration(limits.ReadHeaderTimeout) * time.Millisecond
+	}
+	if limits.IdleTimeout > 0 {
+		server.IdleTimeout = time.Duration(limits.IdleTimeout) * time.Millisecond
+	}
+	server.ReadTimeout = time.Duration(limits.ReadTimeout) * time.Millisecond
+	server.WriteTimeout = time.Duration(limits.WriteTimeout) * time.Millisecond
+	server.MaxHeaderBytes = limits.MaxHeaderBytes
+	return server
+}
+
+// listenerTLSConfig adds verifying client certificates to the TLS settings if the listener has a CA.
+func listenerTLSConfig(base *tls.Config, c config.ListenerConfig) (*tls.Config, error) {
+	if c.ClientCAFile == "" {
+		if c.ClientAuth != "" {
+			return nil, fmt.Errorf("listener %s has no client CA for client authentication", c.Address)
+		}
+		return base, nil
+	}
+
+	pem, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates are found in %s", c.ClientCAFile)
+	}
+
+	cfg := base.Clone()
+	cfg.ClientCAs = pool
+	switch c.ClientAuth {
+	case "", clientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case clientAuthOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown client authentication %q of %s", c.ClientAuth, c.Address)
+	}
+	return cfg, nil
+}
+
+// checkClientCertRoutes returns an error if a route requires client certificates
+// while a listener serving the proxy doesn't request them, its requests would be always rejected.
+func checkClientCertRoutes(listeners []config.ListenerConfig, routes []config.RouteConfig) error {
+	for _, r := range routes {
+		if !r.RequireClientCert && r.ClientCAFile == "" {
+			continue
+		}
+		for _, c := range listeners {
+			if hasPurpose(c, purposeProxy) && (!c.TLS || c.ClientCAFile == "") {
+				return fmt.Errorf("route %s requires client certificates, listener %s has no client CA", r.Path, c.Address)
+			}
+		}
+	}
+	return nil
+}
+
+// readsProxyProtocol returns true if the listener expects PROXY headers.
+// The global setting applies only to the listeners serving the proxy,
+// so the metrics and ACME challenges stay reachable without a load balancer in front.
+func readsProxyProtocol(c config.ListenerConfig, proxyProtocol bool) bool {
+	return c.ProxyProtocol || (proxyProtocol && hasPurpose(c, purposeProxy))
+}
+
+func hasPurpose(c config.ListenerConfig, purpose string) bool {
+	for _, p := range c.Purposes {
+		if p == purpose {
+			return true
+		}
+	}
+	return false
+}
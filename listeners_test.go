@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pelageech/BDUTS/config"
+)
+
+func TestReadsProxyProtocol(t *testing.T) {
+	proxy := config.ListenerConfig{Address: ":443", Purposes: []string{purposeProxy, purposeAdmin}}
+	metrics := config.ListenerConfig{Address: ":8081", Purposes: []string{purposeMetrics}}
+	acme := config.ListenerConfig{Address: ":80", RedirectToHTTPS: true, ACMEChallenges: true}
+	acmeBehindProxy := acme
+	acmeBehindProxy.ProxyProtocol = true
+
+	tests := []struct {
+		name     string
+		listener config.ListenerConfig
+		global   bool
+		expected bool
+	}{
+		{"proxy", proxy, true, true},
+		{"metrics", metrics, true, false},
+		{"acme", acme, true, false},
+		{"acme with the flag", acmeBehindProxy, false, true},
+		{"proxy without the flag", proxy, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readsProxyProtocol(tt.listener, tt.global); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// writeCAFile writes a self-signed CA certificate to a PEM file.
+func writeCAFile(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestListenerTLSConfig(t *testing.T) {
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	ca := writeCAFile(t)
+	notPEM := filepath.Join(t.TempDir(), "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("no certificates"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		listener   config.ListenerConfig
+		clientAuth tls.ClientAuthType
+		fails      bool
+	}{
+		{"no client CA", config.ListenerConfig{}, tls.NoClientCert, false},
+		{"auth without client CA", config.ListenerConfig{ClientAuth: clientAuthOptional}, 0, true},
+		{"required by default", config.ListenerConfig{ClientCAFile: ca}, tls.RequireAndVerifyClientCert, false},
+		{"required", config.ListenerConfig{ClientCAFile: ca, ClientAuth: clientAuthRequire}, tls.RequireAndVerifyClientCert, false},
+		{"optional", config.ListenerConfig{ClientCAFile: ca, ClientAuth: clientAuthOptional}, tls.VerifyClientCertIfGiven, false},
+		{"unknown auth", config.ListenerConfig{ClientCAFile: ca, ClientAuth: "sometimes"}, 0, true},
+		{"missing file", config.ListenerConfig{ClientCAFile: filepath.Join(t.TempDir(), "none.pem")}, 0, true},
+		{"no certificates", config.ListenerConfig{ClientCAFile: notPEM}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := listenerTLSConfig(base, tt.listener)
+			if tt.fails {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ClientAuth != tt.clientAuth {
+				t.Errorf("expected client auth %v, got %v", tt.clientAuth, cfg.ClientAuth)
+			}
+			if cfg.MinVersion != base.MinVersion {
+				t.Error("the base settings are lost")
+			}
+			if tt.listener.ClientCAFile != "" && (cfg == base || cfg.ClientCAs == nil) {
+				t.Error("expected a copy of the base settings with the client CAs")
+			}
+		})
+	}
+}
+
+func TestCheckClientCertRoutes(t *testing.T) {
+	ca := "resources/ca.pem"
+	mtls := config.ListenerConfig{Address: ":8443", TLS: true, Purposes: []string{purposeProxy}, ClientCAFile: ca}
+	plainTLS := config.ListenerConfig{Address: ":443", TLS: true, Purposes: []string{purposeProxy}}
+	metrics := config.ListenerConfig{Address: ":8081", Purposes: []string{purposeMetrics}}
+
+	tests := []struct {
+		name      string
+		listeners []config.ListenerConfig
+		routes    []config.RouteConfig
+		fails     bool
+	}{
+		{"no certificates required", []config.ListenerConfig{plainTLS}, []config.RouteConfig{{Path: "/"}}, false},
+		{"mTLS listener", []config.ListenerConfig{mtls, metrics}, []config.RouteConfig{{Path: "/", RequireClientCert: true}}, false},
+		{"listener without CA", []config.ListenerConfig{mtls, plainTLS}, []config.RouteConfig{{Path: "/", RequireClientCert: true}}, true},
+		{"route CA", []config.ListenerConfig{plainTLS}, []config.RouteConfig{{Path: "/", ClientCAFile: ca}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkClientCertRoutes(tt.listeners, tt.routes); (err != nil) != tt.fails {
+				t.Errorf("expected failure %v, got %v", tt.fails, err)
+			}
+		})
+	}
+}
@@ -1,26 +1,43 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/charmbracelet/log"
 	"github.com/go-playground/validator/v10"
 	"github.com/pelageech/BDUTS/auth"
 	"github.com/pelageech/BDUTS/backend"
 	"github.com/pelageech/BDUTS/cache"
+	"github.com/pelageech/BDUTS/certs"
 	"github.com/pelageech/BDUTS/config"
+	"github.com/pelageech/BDUTS/connlimit"
 	"github.com/pelageech/BDUTS/db"
+	"github.com/pelageech/BDUTS/discovery"
 	"github.com/pelageech/BDUTS/email"
+	"github.com/pelageech/BDUTS/jwtkeys"
+	"github.com/pelageech/BDUTS/l4"
 	"github.com/pelageech/BDUTS/lb"
 	"github.com/pelageech/BDUTS/metrics"
+	"github.com/pelageech/BDUTS/proxyproto"
+	"github.com/pelageech/BDUTS/ratelimit"
+	"github.com/pelageech/BDUTS/realip"
 	"github.com/pelageech/BDUTS/timer"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -28,22 +45,35 @@ const (
 	lbConfigPath      = "./resources/config.json"
 	serversConfigPath = "./resources/servers.json"
 
-	loggerPrefixMain  = "BDUTS"
-	loggerPrefixCache = "BDUTS_CACHE"
-	loggerPrefixLB    = "BDUTS_LB"
-	loggerPrefixTimer = "BDUTS_TIMER"
-	loggerPrefixPool  = "BDUTS_POOL"
+	loggerPrefixMain      = "BDUTS"
+	loggerPrefixCache     = "BDUTS_CACHE"
+	loggerPrefixLB        = "BDUTS_LB"
+	loggerPrefixTimer     = "BDUTS_TIMER"
+	loggerPrefixPool      = "BDUTS_POOL"
+	loggerPrefixDiscovery = "BDUTS_DISCOVERY"
+	loggerPrefixL4        = "BDUTS_L4"
+	loggerPrefixCerts     = "BDUTS_CERTS"
+	loggerPrefixJWTKeys   = "BDUTS_JWT_KEYS"
 
 	readWriteExecuteOwnerGroupOthers = 0o777
 	readWriteExecuteOwner            = 0o700
 
-	goroutinesToWait = 2
-
 	usersDB            = "./db/users.db"
 	usersDBPermissions = 0o600
+	acmeDB             = "./db/acme.db"
 
 	certFile = "resources/fullchain.pem"
 	keyFile  = "resources/privkey.pem"
+
+	defaultCertReloadPeriod = 10 * time.Second
+	defaultShutdownTimeout  = 30 * time.Second
+	rateLimitExpirePeriod   = time.Minute
+
+	proxyHeaderTimeout = 5 * time.Second
+
+	// the previous process releases the databases before starting a new one,
+	// the timeout guards against other processes holding them
+	dbOpenTimeout = 30 * time.Second
 )
 
 var logger *log.Logger
@@ -83,6 +113,7 @@ func serversConfigure() []config.ServerConfig {
 	if err != nil {
 		logger.Fatal("Failed to read ServersConfig", "err", err)
 	}
+
 	return serversConfig
 }
 
@@ -123,6 +154,14 @@ func main() {
 	backend.LoggerConfig(loggerPrefixPool)
 	timer.LoggerConfig(loggerPrefixTimer)
 	lb.LoggerConfig(loggerPrefixLB)
+	discovery.LoggerConfig(loggerPrefixDiscovery)
+	l4.LoggerConfig(loggerPrefixL4)
+	certs.LoggerConfig(loggerPrefixCerts)
+	jwtkeys.LoggerConfig(loggerPrefixJWTKeys)
+
+	// SIGINT and SIGTERM start graceful shutdown, see shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	lbConfJSON := loadBalancerConfigure()
 	lbConfig := lb.NewLoadBalancerConfig(
@@ -130,6 +169,7 @@ func main() {
 		time.Duration(lbConfJSON.HealthCheckPeriod)*time.Millisecond,
 		lbConfJSON.MaxCacheSize,
 		time.Duration(lbConfJSON.ObserveFrequency)*time.Millisecond,
+		lbConfJSON.MaxCacheableResponseSize,
 	)
 
 	// database
@@ -137,11 +177,11 @@ func main() {
 	if err := os.Mkdir(cache.DbDirectory, readWriteExecuteOwner); err != nil && !os.IsExist(err) {
 		logger.Fatal("Couldn't create a directory "+cache.DbDirectory, "err", err)
 	}
-	boltdb, err := cache.OpenDatabase(cache.DbDirectory + "/" + cache.DbName)
+	dbOptions := &bolt.Options{Timeout: dbOpenTimeout}
+	boltdb, err := cache.OpenDatabase(cache.DbDirectory+"/"+cache.DbName, dbOptions)
 	if err != nil {
 		logger.Fatal("Failed to open boltdb", "err", err)
 	}
-	defer cache.CloseDatabase(boltdb)
 
 	// thread that clears the cache
 	dbControllerTicker := time.NewTicker(lbConfig.ObserveFrequency())
@@ -149,8 +189,15 @@ func main() {
 	defer dbControllerTicker.Stop()
 
 	cacheProps := cache.NewCachingProperties(boltdb, controller)
+	databases := []database{{name: "Cache", boltDatabase: cacheProps}}
+	defer func() {
+		closeDatabases(databases)
+	}()
 	cacheProps.CalculateSize()
 
+	// prometheus part, metrics are initialized before backends can be used
+	metrics.Init(cacheProps.Size, cacheProps.PagesCount)
+
 	// health checker configuration
 	healthCheckFunc := func(server *backend.Backend) {
 		alive := server.CheckIfAlive()
@@ -163,12 +210,27 @@ func main() {
 	}
 
 	// creating new load balancer
-	loadBalancer := lb.NewLoadBalancerWithPool(
+	loadBalancer := lb.NewLoadBalancer(
 		lbConfig,
 		cacheProps,
 		healthCheckFunc,
-		serversConfigure(),
 	)
+	// the common TLS settings apply to the backends of every source
+	loadBalancer.Pool().SetUpstreamTLS(lbConfJSON.UpstreamTLS)
+	loadBalancer.Pool().ConfigureServerPool(serversConfigure())
+	if err := loadBalancer.SetRoutes(lbConfJSON.Routes); err != nil {
+		logger.Fatal("Failed to configure routes", "err", err)
+	}
+	if err := loadBalancer.SetLoadShedding(lbConfJSON.LoadShedding); err != nil {
+		logger.Fatal("Failed to configure load shedding", "err", err)
+	}
+
+	clientIPResolver, err := realip.NewResolver(lbConfJSON.TrustedProxies)
+	if err != nil {
+		logger.Fatal("Failed to parse trusted proxies", "err", err)
+	}
+	loadBalancer.SetClientIPResolver(clientIPResolver)
+	loadBalancer.SetClientCertHeaders(lbConfJSON.ClientCertSubjectHeader, lbConfJSON.ClientCertSANsHeader)
 
 	// Firstly, identify the working servers
 	logger.Info("Configured! Now setting up the first health check...")
@@ -186,8 +248,60 @@ func main() {
 	logger.Info("Ready!")
 
 	// set up health check
-	go loadBalancer.HealthChecker()
-	go loadBalancer.CacheProps().Observe()
+	go loadBalancer.HealthChecker(ctx)
+	go loadBalancer.CacheProps().Observe(ctx)
+	go loadBalancer.RegistrationObserver(ctx)
+
+	// service discovery adds and removes backends in addition to servers.json
+	if lbConfJSON.Discovery != nil {
+		registry := discovery.NewHTTPRegistry(lbConfJSON.Discovery)
+		go func() {
+			err := discovery.Run(ctx, registry, loadBalancer.Pool(), loadBalancer.HealthCheckFunc())
+			if err != nil && !errors.Is(err, context.Canceled) {
+				logger.Error("Service discovery stopped", "err", err)
+			}
+		}()
+	}
+
+	// layer-4 proxies have their own pools and listeners, they are closed on shutdown
+	// and the TCP connections are waited for
+	var l4Listeners []io.Closer
+	var tcpProxies []*l4.TCPProxy
+	for _, c := range lbConfJSON.TCPProxies {
+		name := fmt.Sprintf("tcp:%d", c.Port)
+		proxy := l4.NewTCPProxy(name, c, lbConfig.HealthCheckPeriod(), healthCheckFunc)
+		proxy.CheckHealth()
+		tcpProxies = append(tcpProxies, proxy)
+
+		tcpLn, err := listen(fmt.Sprintf(":%d", c.Port))
+		if err != nil {
+			logger.Fatal("Failed to start tcp proxy listener", "err", err)
+		}
+		l4Listeners = append(l4Listeners, tcpLn)
+		go func() {
+			if err := proxy.Serve(tcpLn); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Error("TCP proxy stopped", "proxy", name, "err", err)
+			}
+		}()
+		go proxy.HealthChecker(ctx)
+	}
+	for _, c := range lbConfJSON.UDPProxies {
+		name := fmt.Sprintf("udp:%d", c.Port)
+		proxy := l4.NewUDPProxy(name, c, lbConfig.HealthCheckPeriod(), healthCheckFunc)
+		proxy.CheckHealth()
+
+		pc, err := listenPacket(fmt.Sprintf(":%d", c.Port))
+		if err != nil {
+			logger.Fatal("Failed to start udp proxy listener", "err", err)
+		}
+		l4Listeners = append(l4Listeners, pc)
+		go func() {
+			if err := proxy.Serve(pc); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Error("UDP proxy stopped", "proxy", name, "err", err)
+			}
+		}()
+		go proxy.HealthChecker(ctx)
+	}
 
 	dbService := db.Service{}
 	dbService.SetLogger(logger)
@@ -199,20 +313,12 @@ func main() {
 		addDefaultUser = true
 	}
 
-	err = dbService.Connect(usersDB, usersDBPermissions, nil)
+	err = dbService.Connect(usersDB, usersDBPermissions, dbOptions)
 	if err != nil {
 		logger.Fatal("Unable to connect to users bolt database", "err", err)
 	}
 	logger.Info("Connected to users bolt database")
-
-	defer func(dbService *db.Service) {
-		err = dbService.Close()
-		if err != nil {
-			logger.Warn("Unable to close users bolt database", "err", err)
-			return
-		}
-		logger.Info("Users bolt database is closed")
-	}(&dbService)
+	databases = append(databases, database{name: "Users", boltDatabase: &dbService})
 
 	// set up email
 	smtpUser := os.Getenv("SMTP_USER")
@@ -232,6 +338,22 @@ func main() {
 	}
 	authSvc := auth.New(&dbService, sender, validate, []byte(signKey), logger)
 
+	// the buckets of the clients which haven't sent requests for a while are deleted,
+	// the tokens of the limits by JWT are issued for the clients, not for the admin API
+	rateLimitStore := ratelimit.NewMemoryStore()
+	go rateLimitStore.Expire(ctx, rateLimitExpirePeriod)
+	var rateLimitKeys *jwtkeys.Keys
+	if c := lbConfJSON.RateLimitJWT; c != nil {
+		rateLimitKeys, err = jwtkeys.New(c)
+		if err != nil {
+			logger.Fatal("Failed to configure the keys of the rate limits", "err", err)
+		}
+		go rateLimitKeys.Refresh(ctx)
+	}
+	if err := loadBalancer.SetRateLimits(lbConfJSON.RateLimits, rateLimitStore, rateLimitKeys); err != nil {
+		logger.Fatal("Failed to configure rate limits", "err", err)
+	}
+
 	if addDefaultUser {
 		err = authSvc.SignUpDefaultUser()
 		if err != nil {
@@ -260,50 +382,248 @@ func main() {
 	}
 
 	// Serving
-	http.HandleFunc("/", loadBalancer.LoadBalancerHandler)
-	http.Handle("/serverPool/add", cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(loadBalancer.AddServerHandler))))
-	http.Handle("/serverPool/remove", cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(loadBalancer.RemoveServerHandler))))
-	http.Handle("/serverPool", cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(loadBalancer.GetServersHandler))))
-	http.Handle("/admin/signup", cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(authSvc.SignUp))))
-	http.Handle("/admin/password", cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(authSvc.ChangePassword))))
-	http.Handle("/admin/signin", cors(http.HandlerFunc(authSvc.SignIn)))
-	http.Handle("/admin", cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(authSvc.DeleteUser))))
-	http.Handle("/admin/clear", cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(loadBalancer.ClearCacheHandler))))
-
-	// Config TLS: setting a pair crt-key
-	Crt, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		logger.Fatal("Failed to load crt and key", "err", err)
+	proxyHandler := http.HandlerFunc(loadBalancer.LoadBalancerHandler)
+	adminHandlers := map[string]http.Handler{
+		"/serverPool/add":      cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(loadBalancer.AddServerHandler))),
+		"/serverPool/register": cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(loadBalancer.RegisterServerHandler))),
+		"/serverPool/remove":   cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(loadBalancer.RemoveServerHandler))),
+		"/serverPool":          cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(loadBalancer.GetServersHandler))),
+		"/admin/signup":        cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(authSvc.SignUp))),
+		"/admin/password":      cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(authSvc.ChangePassword))),
+		"/admin/signin":        cors(http.HandlerFunc(authSvc.SignIn)),
+		"/admin":               cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(authSvc.DeleteUser))),
+		"/admin/clear":         cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(loadBalancer.ClearCacheHandler))),
 	}
 
-	tlsConfig := &tls.Config{Certificates: []tls.Certificate{Crt}}
+	listeners := lbConfJSON.Listeners
+	if len(listeners) == 0 {
+		listeners = defaultListeners(loadBalancer.Config().Port())
+	}
+	if err := checkClientCertRoutes(listeners, lbConfJSON.Routes); err != nil {
+		logger.Fatal("Failed to configure client authentication", "err", err)
+	}
 
-	ln, err := tls.Listen("tcp", fmt.Sprintf(":%d", loadBalancer.Config().Port()), tlsConfig)
-	if err != nil {
-		logger.Fatal("Failed to start tcp listener", "err", err)
+	// Config TLS: certificates are chosen by SNI and reloaded when the files change
+	certDir, certReloadPeriod := "", defaultCertReloadPeriod
+	if c := lbConfJSON.Certificates; c != nil {
+		certDir = c.Directory
+		if c.ReloadPeriod > 0 {
+			certReloadPeriod = time.Duration(c.ReloadPeriod) * time.Millisecond
+		}
+	}
+	certStore := certs.NewStore(certFile, keyFile, certDir)
+	go certStore.Watch(ctx, certReloadPeriod)
+	adminHandlers["/admin/certs"] = cors(authSvc.AuthenticationMiddleware(http.HandlerFunc(certStore.CertificatesHandler)))
+
+	var tlsConfig *tls.Config
+	if !certStore.Empty() {
+		tlsConfig = &tls.Config{
+			GetCertificate: certStore.GetCertificate,
+			NextProtos:     []string{http2.NextProtoTLS, "http/1.1"},
+		}
 	}
 
-	wg.Add(goroutinesToWait)
-	logger.Infof("Load Balancer started at :%d\n", loadBalancer.Config().Port())
-	go func() {
-		if err := http.Serve(ln, nil); err != nil {
-			logger.Fatal("Failed to serve tcp listener", "err", err)
+	// ACME certificates are kept in their own database,
+	// the names out of the ACME domains are served from the files
+	var acmeClient *certs.ACME
+	if lbConfJSON.ACME != nil {
+		acmeCache, err := db.OpenACMECache(acmeDB, usersDBPermissions, dbOptions)
+		if err != nil {
+			logger.Fatal("Unable to open ACME bolt database", "err", err)
 		}
-		wg.Done()
-	}()
+		databases = append(databases, database{name: "ACME", boltDatabase: acmeCache})
 
-	// prometheus part
-	metrics.Init(loadBalancer.CacheProps().Size, loadBalancer.CacheProps().PagesCount)
-	server := http.Server{
-		Addr:    ":8081",
-		Handler: metrics.Handler(),
+		acmeClient, err = certs.NewACME(lbConfJSON.ACME, acmeCache, certStore)
+		if err != nil {
+			logger.Fatal("Failed to configure ACME", "err", err)
+		}
+		tlsConfig = &tls.Config{
+			GetCertificate: acmeClient.GetCertificate,
+			NextProtos:     []string{http2.NextProtoTLS, "http/1.1", acme.ALPNProto},
+		}
+
+		if port := lbConfJSON.ACME.HTTPPort; port != 0 {
+			listeners = append(listeners, config.ListenerConfig{
+				Address:         fmt.Sprintf(":%d", port),
+				RedirectToHTTPS: true,
+				ACMEChallenges:  true,
+			})
+		}
 	}
 
+	// TLS connections with the configured server names aren't terminated
+	passthroughRoutes := make(map[string]*l4.TCPProxy)
+	for _, c := range lbConfJSON.Passthrough {
+		name := "sni:" + strings.Join(c.ServerNames, ",")
+		proxy := l4.NewTCPProxy(name, config.TCPProxyConfig{
+			Servers:           c.Servers,
+			HealthCheckPeriod: c.HealthCheckPeriod,
+			IdleTimeout:       c.IdleTimeout,
+		}, lbConfig.HealthCheckPeriod(), healthCheckFunc)
+		proxy.CheckHealth()
+		go proxy.HealthChecker(ctx)
+		tcpProxies = append(tcpProxies, proxy)
+
+		for _, serverName := range c.ServerNames {
+			passthroughRoutes[serverName] = proxy
+		}
+	}
+
+	// the limits of the downstream connections are shared by all the HTTP listeners
+	var connLimits *connlimit.Limits
+	if d := lbConfJSON.Downstream; d != nil && (d.MaxConnections > 0 || d.MaxConnectionsPerIP > 0) {
+		connLimits = connlimit.NewLimits(d.MaxConnections, d.MaxConnectionsPerIP)
+	}
+
+	// the HTTP listeners are paused while the databases are handed off
+	gate := newHandoffGate()
+	servers := make([]*http.Server, 0, len(listeners))
+	for _, c := range listeners {
+		c := c
+		handler, err := listenerHandler(c, proxyHandler, adminHandlers, acmeClient)
+		if err != nil {
+			logger.Fatal("Failed to configure listener", "err", err)
+		}
+		handler = gate.handler(handler)
+
+		ln, err := listen(c.Address)
+		if err != nil {
+			logger.Fatal("Failed to start tcp listener", "address", c.Address, "err", err)
+		}
+		ln = gate.listener(ln)
+
+		// the client address is taken from PROXY header sent by a TCP load balancer in front
+		if readsProxyProtocol(c, lbConfJSON.ProxyProtocol) {
+			var trusted func(net.IP) bool
+			if len(lbConfJSON.TrustedProxies) > 0 {
+				trusted = clientIPResolver.IsTrusted
+			}
+			ln = proxyproto.NewListener(ln, trusted, proxyHeaderTimeout)
+		}
+
+		// the limit per address is checked after the PROXY header is read
+		if connLimits != nil || c.MaxConnections > 0 {
+			ln = connlimit.NewListener(ln, c.Address, c.MaxConnections, connLimits)
+		}
+
+		if c.TLS {
+			if tlsConfig == nil {
+				logger.Fatal("Failed to load crt and key", "err", "no certificates are found")
+			}
+			cfg, err := listenerTLSConfig(tlsConfig, c)
+			if err != nil {
+				logger.Fatal("Failed to configure client authentication", "err", err)
+			}
+			if len(passthroughRoutes) > 0 && hasPurpose(c, purposeProxy) {
+				ln = l4.NewSNIListener(ln, passthroughRoutes)
+			}
+			ln = tls.NewListener(ln, cfg)
+		}
+
+		server, err := newListenerServer(c, handler, lbConfJSON.H2C, lbConfJSON.Downstream)
+		if err != nil {
+			logger.Fatal("Failed to configure HTTP/2", "err", err)
+		}
+
+		servers = append(servers, server)
+		logger.Infof("Load Balancer started at %s, TLS: %t, purposes: %v\n", c.Address, c.TLS, c.Purposes)
+		go func() {
+			if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Fatal("Failed to serve tcp listener", "address", c.Address, "err", err)
+			}
+		}()
+	}
+
+	listeningSockets.closeUnused()
+	listeningSockets.notifyReady()
+
+	shutdownTimeout := defaultShutdownTimeout
+	if lbConfJSON.ShutdownTimeout > 0 {
+		shutdownTimeout = time.Duration(lbConfJSON.ShutdownTimeout) * time.Millisecond
+	}
+
+	// SIGUSR2 hands the listening sockets and the databases off to a new process
+	// and shuts this one down
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
+	handOffFunc := func() error {
+		return handOff(gate, databases, dbOptions, shutdownTimeout)
+	}
+	if handedOff := waitForStop(ctx, upgrade, handOffFunc); handedOff {
+		// the databases are used by the new process
+		databases = nil
+	}
+	stop()
+
+	shutdown(servers, l4Listeners, tcpProxies, loadBalancer, shutdownTimeout)
+}
+
+// waitForStop returns when ctx is done or the sockets are handed off to a new process,
+// handedOff is true in the latter case. If the handoff fails, this process goes on serving.
+func waitForStop(ctx context.Context, upgrade <-chan os.Signal, handOff func() error) (handedOff bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-upgrade:
+			if err := handOff(); err != nil {
+				logger.Error("Failed to hand off the sockets", "err", err)
+				continue
+			}
+			logger.Info("The new process is ready")
+			return true
+		}
+	}
+}
+
+// shutdown stops accepting connections and waits for the requests in flight,
+// the upgraded and TCP connections and then for the responses being saved in cache.
+// The connections left after timeout are closed. The databases are closed after it by main.
+func shutdown(
+	servers []*http.Server,
+	l4Listeners []io.Closer,
+	tcpProxies []*l4.TCPProxy,
+	loadBalancer *lb.LoadBalancer,
+	timeout time.Duration,
+) {
+	logger.Infof("Shutting down, waiting for the requests up to %s\n", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, ln := range l4Listeners {
+		_ = ln.Close()
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(servers) + len(tcpProxies) + 1)
+	for _, server := range servers {
+		server := server
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Warn("Requests haven't been completed", "err", err)
+			}
+		}()
+	}
+	for _, proxy := range tcpProxies {
+		proxy := proxy
+		go func() {
+			defer wg.Done()
+			if err := proxy.Shutdown(ctx); err != nil {
+				logger.Warn("TCP connections haven't been closed by the peers", "err", err)
+			}
+		}()
+	}
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			logger.Fatal("Failed to start prometheus server", "err", err)
+		defer wg.Done()
+		if err := loadBalancer.WaitUpgradedConnections(ctx); err != nil {
+			logger.Warn("Upgraded connections haven't been closed by the peers", "err", err)
 		}
-		wg.Done()
 	}()
 	wg.Wait()
+
+	if err := loadBalancer.WaitCacheWrites(ctx); err != nil {
+		logger.Warn("Responses haven't been saved in cache", "err", err)
+	}
+	logger.Info("All the requests have been completed")
 }
@@ -1,9 +1,11 @@
 package metrics
 
 import (
-	"io"
+	"math"
 	"net/http"
 	"runtime"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,6 +15,12 @@ import (
 
 const timeObserve = 1 * time.Second
 
+const (
+	backendLabel  = "backend"
+	listenerLabel = "listener"
+	protocolLabel = "protocol"
+)
+
 type Metrics struct {
 	CPU                   prometheus.Gauge
 	MaxMemory             prometheus.Gauge
@@ -25,10 +33,30 @@ type Metrics struct {
 	RequestBodySize       prometheus.Histogram
 	ResponseBodySize      prometheus.Histogram
 	BackendProcessingTime prometheus.Histogram
+	TransferTime          prometheus.Histogram
 	CacheProcessingTime   prometheus.Histogram
 	FullTripTime          prometheus.Summary
+
+	BackendOpenConnections     *prometheus.GaugeVec
+	BackendDials               *prometheus.CounterVec
+	BackendAcquiredConnections *prometheus.CounterVec
+	BackendConcurrencyLimit    *prometheus.GaugeVec
+	UpgradedConnectionsNow     *prometheus.GaugeVec
+	UpgradedConnections        *prometheus.CounterVec
+	HedgedRequests             *prometheus.CounterVec
+	ShedRequests               *prometheus.CounterVec
+	RateLimitedRequests        *prometheus.CounterVec
+
+	L4ConnectionsNow   *prometheus.GaugeVec
+	L4Connections      *prometheus.CounterVec
+	L4Bytes            *prometheus.CounterVec
+	L4DroppedDatagrams *prometheus.CounterVec
+
+	DownstreamConnectionsNow *prometheus.GaugeVec
+	RejectedConnections      *prometheus.CounterVec
 }
 
+// NewMetrics creates the metrics and registers them in reg if it isn't nil.
 func NewMetrics(reg prometheus.Registerer) *Metrics {
 	m := &Metrics{
 		CPU: prometheus.NewGauge(prometheus.GaugeOpts{
@@ -69,6 +97,11 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 		}),
 		BackendProcessingTime: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name: "bduts_backend_processing_time",
+			Help: "Time to the first byte of the backend response",
+		}),
+		TransferTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "bduts_response_transfer_time",
+			Help: "Time of streaming the backend response body to the client",
 		}),
 		CacheProcessingTime: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name: "bduts_cache_processing_time",
@@ -76,6 +109,69 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 		FullTripTime: prometheus.NewSummary(prometheus.SummaryOpts{
 			Name: "bduts_full_trip_time",
 		}),
+		BackendOpenConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bduts_backend_open_connections",
+			Help: "How many connections to the backend are open now",
+		}, []string{backendLabel}),
+		BackendDials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bduts_backend_dials",
+			Help: "How many connections to the backend were dialed",
+		}, []string{backendLabel, "failed"}),
+		BackendAcquiredConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bduts_backend_acquired_connections",
+			Help: "How many connections were taken from the pool for sending requests to the backend",
+		}, []string{backendLabel, "reused"}),
+		BackendConcurrencyLimit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bduts_backend_concurrency_limit",
+			Help: "How many requests can be processed on the backend at the same time now",
+		}, []string{backendLabel}),
+		UpgradedConnectionsNow: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bduts_upgraded_connections_are_open",
+			Help: "How many upgraded connections (e.g. WebSockets) are open now",
+		}, []string{backendLabel}),
+		UpgradedConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bduts_upgraded_connections",
+			Help: "How many connections were upgraded summary",
+		}, []string{backendLabel}),
+		HedgedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bduts_hedged_requests",
+			Help: "How many requests were sent to a second backend, won is true if its response was used",
+		}, []string{"won"}),
+		ShedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bduts_shed_requests",
+			Help: "How many requests were rejected because the balancer was overloaded",
+		}, []string{"priority"}),
+		RateLimitedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bduts_rate_limited_requests",
+			Help: "How many requests were rejected by the rate limits",
+		}, []string{"key"}),
+		L4ConnectionsNow: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bduts_l4_connections_are_open",
+			Help: "How many TCP connections or UDP sessions are proxied now",
+		}, []string{listenerLabel, protocolLabel}),
+		L4Connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bduts_l4_connections",
+			Help: "How many TCP connections or UDP sessions were proxied summary",
+		}, []string{listenerLabel, protocolLabel}),
+		L4Bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bduts_l4_bytes",
+			Help: "How many bytes were received from clients and sent to them",
+		}, []string{listenerLabel, protocolLabel, "direction"}),
+		L4DroppedDatagrams: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bduts_l4_dropped_datagrams",
+			Help: "How many UDP datagrams of clients were dropped because no backend could take them",
+		}, []string{listenerLabel}),
+		DownstreamConnectionsNow: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bduts_downstream_connections_are_open",
+			Help: "How many client connections of the listener are open now",
+		}, []string{listenerLabel}),
+		RejectedConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bduts_rejected_connections",
+			Help: "How many client connections were closed because of the connection limits",
+		}, []string{listenerLabel, "reason"}),
+	}
+	if reg == nil {
+		return m
 	}
 	reg.MustRegister(
 		m.CPU,
@@ -88,24 +184,51 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 		m.RequestBodySize,
 		m.ResponseBodySize,
 		m.BackendProcessingTime,
+		m.TransferTime,
 		m.CacheProcessingTime,
 		m.FullTripTime,
+		m.BackendOpenConnections,
+		m.BackendDials,
+		m.BackendAcquiredConnections,
+		m.BackendConcurrencyLimit,
+		m.UpgradedConnectionsNow,
+		m.UpgradedConnections,
+		m.HedgedRequests,
+		m.ShedRequests,
+		m.RateLimitedRequests,
+		m.L4ConnectionsNow,
+		m.L4Connections,
+		m.L4Bytes,
+		m.L4DroppedDatagrams,
+		m.DownstreamConnectionsNow,
+		m.RejectedConnections,
 	)
 	return m
 }
 
+// GlobalMetrics isn't registered until Init, so the metrics updated
+// before it, e.g. in tests, are just dropped.
 var (
 	reg           *prometheus.Registry
-	GlobalMetrics *Metrics
+	GlobalMetrics = NewMetrics(nil)
 )
 
+// cpuPercent is the last CPU usage sample, it's kept as math.Float64bits.
+var cpuPercent atomic.Uint64
+
 func UpdateCPU() {
 	p, err := cpu.Percent(0, false)
 	if err == nil {
 		GlobalMetrics.CPU.Set(p[0])
+		cpuPercent.Store(math.Float64bits(p[0]))
 	}
 }
 
+// CPUPercent returns the CPU usage sampled by UpdateCPU every second.
+func CPUPercent() float64 {
+	return math.Float64frombits(cpuPercent.Load())
+}
+
 func UpdateMemory() {
 	m := runtime.MemStats{}
 	runtime.ReadMemStats(&m)
@@ -120,12 +243,8 @@ func UpdateCachePagesCount(delta int) {
 	GlobalMetrics.CachePagesCount.Add(float64(delta))
 }
 
-func UpdateRequestBodySize(req *http.Request) {
-	b, err := io.ReadAll(req.Body)
-	if err != nil {
-		return
-	}
-	GlobalMetrics.RequestBodySize.Observe(float64(len(b)))
+func UpdateRequestBodySize(size float64) {
+	GlobalMetrics.RequestBodySize.Observe(size)
 }
 
 func UpdateResponseBodySize(size float64) {
@@ -136,6 +255,10 @@ func UpdateBackendProcessingTime(time float64) {
 	GlobalMetrics.BackendProcessingTime.Observe(time)
 }
 
+func UpdateTransferTime(time float64) {
+	GlobalMetrics.TransferTime.Observe(time)
+}
+
 func UpdateCacheProcessingTime(time float64) {
 	GlobalMetrics.CacheProcessingTime.Observe(time)
 }
@@ -144,6 +267,81 @@ func UpdateFullTripTime(time float64) {
 	GlobalMetrics.FullTripTime.Observe(time)
 }
 
+func UpdateBackendOpenConnections(backend string, delta int) {
+	GlobalMetrics.BackendOpenConnections.WithLabelValues(backend).Add(float64(delta))
+}
+
+func UpdateBackendDials(backend string, failed bool) {
+	GlobalMetrics.BackendDials.WithLabelValues(backend, strconv.FormatBool(failed)).Inc()
+}
+
+func UpdateBackendAcquiredConnections(backend string, reused bool) {
+	GlobalMetrics.BackendAcquiredConnections.WithLabelValues(backend, strconv.FormatBool(reused)).Inc()
+}
+
+func UpdateUpgradedConnections(backend string, delta int) {
+	GlobalMetrics.UpgradedConnectionsNow.WithLabelValues(backend).Add(float64(delta))
+	if delta > 0 {
+		GlobalMetrics.UpgradedConnections.WithLabelValues(backend).Add(float64(delta))
+	}
+}
+
+func UpdateHedgedRequests(won bool) {
+	GlobalMetrics.HedgedRequests.WithLabelValues(strconv.FormatBool(won)).Inc()
+}
+
+func UpdateShedRequests(priority string) {
+	GlobalMetrics.ShedRequests.WithLabelValues(priority).Inc()
+}
+
+// UpdateRateLimitedRequests counts the request rejected by the rate limit with key.
+func UpdateRateLimitedRequests(key string) {
+	GlobalMetrics.RateLimitedRequests.WithLabelValues(key).Inc()
+}
+
+func UpdateL4Connections(listener, protocol string, delta int) {
+	GlobalMetrics.L4ConnectionsNow.WithLabelValues(listener, protocol).Add(float64(delta))
+	if delta > 0 {
+		GlobalMetrics.L4Connections.WithLabelValues(listener, protocol).Add(float64(delta))
+	}
+}
+
+// UpdateL4Bytes counts bytes, direction is "received" for bytes from clients
+// and "sent" for bytes to them.
+func UpdateL4Bytes(listener, protocol, direction string, n int) {
+	GlobalMetrics.L4Bytes.WithLabelValues(listener, protocol, direction).Add(float64(n))
+}
+
+// UpdateL4DroppedDatagrams counts the datagram of a client dropped by the UDP proxy.
+func UpdateL4DroppedDatagrams(listener string) {
+	GlobalMetrics.L4DroppedDatagrams.WithLabelValues(listener).Inc()
+}
+
+func UpdateDownstreamConnections(listener string, delta int) {
+	GlobalMetrics.DownstreamConnectionsNow.WithLabelValues(listener).Add(float64(delta))
+}
+
+// UpdateRejectedConnections counts the connection closed by the limit named in reason.
+func UpdateRejectedConnections(listener, reason string) {
+	GlobalMetrics.RejectedConnections.WithLabelValues(listener, reason).Inc()
+}
+
+// UpdateBackendConcurrencyLimit sets the current limit of concurrent requests of the backend.
+func UpdateBackendConcurrencyLimit(backend string, limit int) {
+	GlobalMetrics.BackendConcurrencyLimit.WithLabelValues(backend).Set(float64(limit))
+}
+
+// DeleteBackend removes the series of the backend removed from the pool.
+func DeleteBackend(backend string) {
+	labels := prometheus.Labels{backendLabel: backend}
+	GlobalMetrics.BackendOpenConnections.DeletePartialMatch(labels)
+	GlobalMetrics.BackendDials.DeletePartialMatch(labels)
+	GlobalMetrics.BackendAcquiredConnections.DeletePartialMatch(labels)
+	GlobalMetrics.BackendConcurrencyLimit.DeletePartialMatch(labels)
+	GlobalMetrics.UpgradedConnectionsNow.DeletePartialMatch(labels)
+	GlobalMetrics.UpgradedConnections.DeletePartialMatch(labels)
+}
+
 func Init(initCacheSize int64, initPagesCount int) {
 	reg = prometheus.NewRegistry()
 	GlobalMetrics = NewMetrics(reg)
@@ -0,0 +1,327 @@
+// Package proxyproto implements the PROXY protocol v1 and v2
+// used by TCP load balancers for passing the client address,
+// see https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+
+	v2HeaderLength = 16
+	v2Version      = 0x20
+	v2CmdLocal     = 0x00
+	v2CmdProxy     = 0x01
+
+	v2FamilyTCP4 = 0x11
+	v2FamilyUDP4 = 0x12
+	v2FamilyTCP6 = 0x21
+	v2FamilyUDP6 = 0x22
+
+	v2AddrLength4 = 12
+	v2AddrLength6 = 36
+)
+
+// v2Signature starts each v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrInvalidHeader is returned if the PROXY header is malformed.
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// Listener accepts connections which start with a PROXY header.
+// The header is read at the first call of Read, RemoteAddr or LocalAddr,
+// so a slow client doesn't block Accept.
+type Listener struct {
+	net.Listener
+
+	// trusted checks if the peer may send the header, nil means any peer.
+	// The connections from other peers are used as is.
+	trusted func(net.IP) bool
+	timeout time.Duration
+}
+
+// NewListener wraps ln. The header must be received within timeout.
+func NewListener(ln net.Listener, trusted func(net.IP) bool, timeout time.Duration) *Listener {
+	return &Listener{
+		Listener: ln,
+		trusted:  trusted,
+		timeout:  timeout,
+	}
+}
+
+// Accept waits for and returns the next connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if l.trusted != nil {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !l.trusted(addr.IP) {
+			return conn, nil
+		}
+	}
+	return NewConn(conn, l.timeout), nil
+}
+
+// Conn is a connection with the addresses taken from the PROXY header.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+
+	// deadlineMu guards the read deadline set by the caller, it's restored
+	// after the header is read within its own deadline
+	deadlineMu     sync.Mutex
+	readDeadline   time.Time
+	headerDeadline time.Time
+}
+
+// NewConn wraps conn. The header must be received within timeout.
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{
+		Conn:    conn,
+		r:       bufio.NewReader(conn),
+		timeout: timeout,
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address from the header or
+// the address of the peer if the header has no addresses.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the header.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection. While the header
+// is being read, the earlier of t and the header deadline is used.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(earlier(t, c.headerDeadline))
+}
+
+func (c *Conn) readHeader() error {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.deadlineMu.Lock()
+			c.headerDeadline = time.Now().Add(c.timeout)
+			_ = c.Conn.SetReadDeadline(earlier(c.readDeadline, c.headerDeadline))
+			c.deadlineMu.Unlock()
+
+			defer func() {
+				c.deadlineMu.Lock()
+				c.headerDeadline = time.Time{}
+				_ = c.Conn.SetReadDeadline(c.readDeadline)
+				c.deadlineMu.Unlock()
+			}()
+		}
+		c.remoteAddr, c.localAddr, c.err = ReadHeader(c.r)
+		if c.err != nil {
+			_ = c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+// earlier returns the earlier of the deadlines, zero means no deadline.
+func earlier(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// ReadHeader reads a v1 or v2 header and returns the source and the destination
+// addresses. The addresses are nil for LOCAL and UNKNOWN connections.
+func ReadHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(sig, v2Signature) {
+		return readV2(r)
+	}
+
+	prefix, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(prefix) != v1Prefix {
+		return nil, nil, ErrInvalidHeader
+	}
+	return readV1(r)
+}
+
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, nil, ErrInvalidHeader
+		}
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, v2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if verCmd&0xF0 != v2Version {
+		return nil, nil, ErrInvalidHeader
+	}
+	switch verCmd & 0x0F {
+	case v2CmdLocal:
+		return nil, nil, nil
+	case v2CmdProxy:
+	default:
+		return nil, nil, ErrInvalidHeader
+	}
+
+	var ipLen int
+	switch family {
+	case v2FamilyTCP4, v2FamilyUDP4:
+		ipLen = net.IPv4len
+	case v2FamilyTCP6, v2FamilyUDP6:
+		ipLen = net.IPv6len
+	default:
+		// unix sockets and unspecified families carry no usable addresses
+		return nil, nil, nil
+	}
+	if length < 2*ipLen+4 {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+
+	if family == v2FamilyUDP4 || family == v2FamilyUDP6 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+// WriteHeaderV2 writes a v2 header with the addresses. If src is nil,
+// a LOCAL header is written, e.g. for health checks.
+func WriteHeaderV2(w io.Writer, src, dst net.Addr) error {
+	header := make([]byte, v2HeaderLength, v2HeaderLength+v2AddrLength6)
+	copy(header, v2Signature)
+
+	srcIP, srcPort := splitAddr(src)
+	dstIP, dstPort := splitAddr(dst)
+	if srcIP == nil || dstIP == nil {
+		header[12] = v2Version | v2CmdLocal
+		_, err := w.Write(header)
+		return err
+	}
+
+	header[12] = v2Version | v2CmdProxy
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		header[13] = v2FamilyTCP4
+		binary.BigEndian.PutUint16(header[14:], v2AddrLength4)
+		header = append(header, src4...)
+		header = append(header, dst4...)
+	} else {
+		header[13] = v2FamilyTCP6
+		binary.BigEndian.PutUint16(header[14:], v2AddrLength6)
+		header = append(header, srcIP.To16()...)
+		header = append(header, dstIP.To16()...)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(srcPort))
+	header = binary.BigEndian.AppendUint16(header, uint16(dstPort))
+
+	_, err := w.Write(header)
+	return err
+}
+
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case nil:
+		return nil, 0
+	default:
+		host, port, err := net.SplitHostPort(a.String())
+		if err != nil {
+			return nil, 0
+		}
+		p, _ := strconv.Atoi(port)
+		return net.ParseIP(host), p
+	}
+}
@@ -0,0 +1,128 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadHeaderV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n"))
+	src, dst, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.String() != "192.0.2.1:56324" || dst.String() != "198.51.100.1:443" {
+		t.Errorf("unexpected addresses %s %s", src, dst)
+	}
+
+	rest, _ := r.ReadString('\n')
+	if rest != "GET / HTTP/1.1\r\n" {
+		t.Errorf("the data after the header is broken: %q", rest)
+	}
+}
+
+func TestReadHeaderV1Unknown(t *testing.T) {
+	src, dst, err := ReadHeader(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n")))
+	if err != nil || src != nil || dst != nil {
+		t.Errorf("expected no addresses and no error, got %v %v %v", src, dst, err)
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n",
+	} {
+		if _, _, err := ReadHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("expected an error for %q", header)
+		}
+	}
+}
+
+func TestHeaderV2RoundTrip(t *testing.T) {
+	tests := []struct {
+		src, dst *net.TCPAddr
+	}{
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			dst: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+		},
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := WriteHeaderV2(&buf, test.src, test.dst); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("payload")
+
+		r := bufio.NewReader(&buf)
+		src, dst, err := ReadHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src.String() != test.src.String() || dst.String() != test.dst.String() {
+			t.Errorf("expected %s %s, got %s %s", test.src, test.dst, src, dst)
+		}
+		if rest, _ := r.ReadString(0); rest != "payload" {
+			t.Errorf("the data after the header is broken: %q", rest)
+		}
+	}
+}
+
+func TestHeaderV2Local(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteHeaderV2(&buf, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	src, dst, err := ReadHeader(bufio.NewReader(&buf))
+	if err != nil || src != nil || dst != nil {
+		t.Errorf("expected LOCAL header, got %v %v %v", src, dst, err)
+	}
+}
+
+func TestConnKeepsReadDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server, time.Minute)
+	defer conn.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nping"))
+	}()
+
+	// the deadline of the caller must outlive reading the header
+	if err := conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("ping"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected the deadline to be exceeded, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the read deadline of the caller is cleared")
+	}
+}
@@ -0,0 +1,144 @@
+// Package ratelimit implements token bucket rate limits whose state
+// is kept in a Store, in memory or shared between balancers.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit lets Burst requests at once and Rate requests per second on average.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Result is the state of the bucket after a request.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+
+	// Reset is the time until the bucket is full, RetryAfter is the time
+	// until the next request is allowed.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets. A store shared between balancers, e.g. in Redis,
+// must take a token atomically.
+type Store interface {
+	// Take takes a token from the bucket of key if there's one.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+
+	// Refund returns a token taken by a request which has been rejected by another limit.
+	Refund(ctx context.Context, key string, limit Limit) error
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// fill adds the tokens for the time passed since the last update.
+func (b *bucket) fill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate)
+	b.updated = now
+}
+
+func (b *bucket) full() bool {
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+// MemoryStore keeps the buckets in memory, the full ones are deleted by Expire.
+type MemoryStore struct {
+	mux     sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take takes a token from the bucket of key, a new bucket is full.
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := s.now()
+	b, ok := s.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.Burst), updated: now, limit: limit}
+		s.buckets[key] = b
+	}
+	b.fill(now)
+
+	r := Result{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		r.Allowed = true
+	} else {
+		r.RetryAfter = seconds((1 - b.tokens) / limit.Rate)
+	}
+	r.Remaining = int(b.tokens)
+	r.Reset = seconds((float64(limit.Burst) - b.tokens) / limit.Rate)
+	return r, nil
+}
+
+// Refund puts a token back to the bucket of key, a bucket is never overfilled.
+func (s *MemoryStore) Refund(_ context.Context, key string, limit Limit) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok || b.limit != limit {
+		return nil
+	}
+	b.fill(s.now())
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+1)
+	return nil
+}
+
+// Len returns the number of buckets.
+func (s *MemoryStore) Len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.buckets)
+}
+
+// Expire deletes the full buckets every period, they're the same as new ones.
+func (s *MemoryStore) Expire(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.expire()
+	}
+}
+
+func (s *MemoryStore) expire() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := s.now()
+	for key, b := range s.buckets {
+		if b.fill(now); b.full() {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
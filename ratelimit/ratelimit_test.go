@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestStore() (*MemoryStore, *time.Time) {
+	now := time.Unix(0, 0)
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func TestTake(t *testing.T) {
+	s, now := newTestStore()
+	limit := Limit{Rate: 2, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		r, _ := s.Take(context.Background(), "a", limit)
+		if !r.Allowed || r.Remaining != i {
+			t.Fatalf("expected an allowed request with %d remaining, got %+v", i, r)
+		}
+	}
+
+	r, _ := s.Take(context.Background(), "a", limit)
+	if r.Allowed || r.RetryAfter != 500*time.Millisecond || r.Reset != 1500*time.Millisecond {
+		t.Fatalf("expected a rejected request retried in 500ms, got %+v", r)
+	}
+
+	// other keys have their own buckets
+	if r, _ := s.Take(context.Background(), "b", limit); !r.Allowed {
+		t.Fatal("the request of another key is rejected")
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if r, _ := s.Take(context.Background(), "a", limit); !r.Allowed {
+		t.Fatal("the request isn't allowed after the bucket is filled")
+	}
+}
+
+func TestRefund(t *testing.T) {
+	s, _ := newTestStore()
+	limit := Limit{Rate: 1, Burst: 2}
+
+	_, _ = s.Take(context.Background(), "a", limit)
+	_, _ = s.Take(context.Background(), "a", limit)
+	if err := s.Refund(context.Background(), "a", limit); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := s.Take(context.Background(), "a", limit); !r.Allowed || r.Remaining != 0 {
+		t.Fatalf("expected the refunded token to be taken, got %+v", r)
+	}
+
+	// a full bucket isn't overfilled
+	_ = s.Refund(context.Background(), "b", limit)
+	_, _ = s.Take(context.Background(), "b", limit)
+	_ = s.Refund(context.Background(), "b", limit)
+	_ = s.Refund(context.Background(), "b", limit)
+	if r, _ := s.Take(context.Background(), "b", limit); r.Remaining != 1 {
+		t.Fatalf("expected 1 remaining token of the full bucket, got %+v", r)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	s, now := newTestStore()
+	limit := Limit{Rate: 1, Burst: 2}
+	_, _ = s.Take(context.Background(), "a", limit)
+	_, _ = s.Take(context.Background(), "b", limit)
+	_, _ = s.Take(context.Background(), "b", limit)
+
+	*now = now.Add(time.Second)
+	s.expire()
+	if s.Len() != 1 {
+		t.Fatalf("expected only the bucket which isn't full, got %d buckets", s.Len())
+	}
+
+	*now = now.Add(time.Second)
+	s.expire()
+	if s.Len() != 0 {
+		t.Fatalf("expected no buckets, got %d", s.Len())
+	}
+}
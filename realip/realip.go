@@ -0,0 +1,101 @@
+// Package realip resolves the real address of a client
+// which is connected through trusted proxies.
+package realip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// Resolver takes the client address from X-Forwarded-For
+// only if the request came from a trusted proxy.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver creates a new Resolver. Each item of trusted
+// is a CIDR or a single IP address.
+func NewResolver(trusted []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, v := range trusted {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: v}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		r.trusted = append(r.trusted, ipNet)
+	}
+	return r, nil
+}
+
+// IsTrusted checks if ip belongs to a trusted proxy.
+func (r *Resolver) IsTrusted(ip net.IP) bool {
+	if r == nil || ip == nil {
+		return false
+	}
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client. X-Forwarded-For is looked through
+// from right to left and the first address not belonging to a trusted proxy is returned.
+func (r *Resolver) ClientIP(req *http.Request) net.IP {
+	peer := PeerIP(req)
+	if !r.IsTrusted(peer) {
+		return peer
+	}
+
+	client := peer
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !r.IsTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// PeerIP returns the address of the immediate peer of the connection.
+func PeerIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// NewContext returns a copy of ctx with the client address.
+func NewContext(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// FromContext returns the client address saved by NewContext.
+func FromContext(ctx context.Context) (net.IP, bool) {
+	ip, ok := ctx.Value(clientIPKey{}).(net.IP)
+	return ip, ok && ip != nil
+}
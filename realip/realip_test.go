@@ -0,0 +1,69 @@
+package realip
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	r, err := NewResolver([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		xForwardedFor []string
+		expected      string
+	}{
+		{
+			name:          "untrusted peer",
+			remoteAddr:    "203.0.113.7:5000",
+			xForwardedFor: []string{"1.2.3.4"},
+			expected:      "203.0.113.7",
+		},
+		{
+			name:          "trusted peer",
+			remoteAddr:    "10.1.2.3:5000",
+			xForwardedFor: []string{"1.2.3.4"},
+			expected:      "1.2.3.4",
+		},
+		{
+			name:          "chain of trusted proxies",
+			remoteAddr:    "10.1.2.3:5000",
+			xForwardedFor: []string{"6.6.6.6, 1.2.3.4", "192.168.1.1, 10.9.9.9"},
+			expected:      "1.2.3.4",
+		},
+		{
+			name:          "trusted peer without header",
+			remoteAddr:    "192.168.1.1:5000",
+			xForwardedFor: nil,
+			expected:      "192.168.1.1",
+		},
+		{
+			name:          "garbage in header",
+			remoteAddr:    "10.1.2.3:5000",
+			xForwardedFor: []string{"1.2.3.4, garbage"},
+			expected:      "10.1.2.3",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+			for _, v := range test.xForwardedFor {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := r.ClientIP(req).String(); got != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestNewResolverError(t *testing.T) {
+	if _, err := NewResolver([]string{"not an address"}); err == nil {
+		t.Error("expected an error")
+	}
+}
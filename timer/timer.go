@@ -47,11 +47,18 @@ func SaveTimerDataGotFromCache(cacheTime time.Duration) {
 
 // SaveTimeDataBackend is used for saving backend to DB.
 // Uses pointer for using in functions with `defer` prefix.
+// The time is measured until the first byte of the response.
 func SaveTimeDataBackend(backendTime time.Duration) {
 	logger.Infof("Backend time: %v", backendTime)
 	metrics.UpdateBackendProcessingTime(float64(backendTime.Milliseconds()))
 }
 
+// SaveTimeTransfer is used for saving time of streaming the response body.
+func SaveTimeTransfer(transferTime time.Duration) {
+	logger.Infof("Transfer time: %v", transferTime)
+	metrics.UpdateTransferTime(float64(transferTime.Milliseconds()))
+}
+
 func SaveTimeFullTrip(fullTime time.Duration) {
 	logger.Infof("Full round trip time: %v", fullTime)
 	metrics.UpdateFullTripTime(float64(fullTime.Milliseconds()))